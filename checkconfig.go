@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/libdns/libdns"
+	"github.com/stvnrhodes/dyncf/ddns"
+	"golang.org/x/time/rate"
+)
+
+// checkConfig checks that every domain of cfg can be updated, without
+// changing anything: that its account has a token, that the token can list
+// the zones and one of them has the domain, and that the records of the zone
+// can be read. It writes a line per domain to w. The config itself has
+// already been validated.
+func checkConfig(ctx context.Context, w io.Writer, cfg *Config) error {
+	limiter := newLimiter(cfg)
+	// Check each account once, in the order the domains use them.
+	var profiles []string
+	byProfile := make(map[string][]DomainConfig)
+	for _, d := range cfg.Domains {
+		if _, ok := byProfile[d.Profile]; !ok {
+			profiles = append(profiles, d.Profile)
+		}
+		byProfile[d.Profile] = append(byProfile[d.Profile], d)
+	}
+	failed := 0
+	for _, profile := range profiles {
+		a, lister, accountErr := checkAccount(ctx, cfg, limiter, profile)
+		// zoneErrs are the results of reading the records of each zone.
+		zoneErrs := make(map[string]error)
+		for _, dc := range byProfile[profile] {
+			d, err := ddns.Domain{}, accountErr
+			if err == nil {
+				d, err = checkDomain(ctx, a, lister, dc.Name, zoneErrs)
+			}
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "FAIL %v: %v\n", dc.Name, err)
+			} else {
+				fmt.Fprintf(w, "OK   %v (zone %v)\n", dc.Name, d.Zone)
+			}
+		}
+	}
+	if failed > 0 {
+		return &exitError{code: exitFailure, err: fmt.Errorf("%d of %d domains failed the check", failed, len(cfg.Domains))}
+	}
+	return nil
+}
+
+// checkAccount returns the account of profile and the zones it can access,
+// which are nil if the provider can't list them.
+func checkAccount(ctx context.Context, cfg *Config, limiter *rate.Limiter, profile string) (account, libdns.ZoneLister, error) {
+	var token string
+	var err error
+	if profile == "" {
+		token, err = cfg.apiToken()
+	} else {
+		if token, err = cfg.Profiles[profile].token(); err != nil {
+			err = fmt.Errorf("profile %v: %w", profile, err)
+		}
+	}
+	if err != nil {
+		return account{}, nil, err
+	}
+	a := newAccount(cfg, limiter, token)
+	if a.lister == nil {
+		return a, nil, nil
+	}
+	zones, err := a.lister.ListZones(ctx)
+	if err != nil {
+		return a, nil, fmt.Errorf("could not list zones: %w", checkTimeout(ctx, err))
+	}
+	return a, zoneList(zones), nil
+}
+
+// checkDomain finds the zone of the domain name and reads its records,
+// unless zoneErrs already has the result of reading them.
+func checkDomain(ctx context.Context, a account, lister libdns.ZoneLister, name string, zoneErrs map[string]error) (ddns.Domain, error) {
+	ds, err := ddns.ResolveDomains(ctx, lister, []string{name})
+	if err != nil {
+		return ddns.Domain{}, err
+	}
+	d := ds[0]
+	err, ok := zoneErrs[d.Zone]
+	if !ok {
+		if _, err = a.provider.GetRecords(ctx, d.Zone); err != nil {
+			err = fmt.Errorf("could not read the records of zone %v: %w", d.Zone, checkTimeout(ctx, err))
+		}
+		zoneErrs[d.Zone] = err
+	}
+	return d, err
+}
+
+// zoneList is a libdns.ZoneLister of zones that were already listed.
+type zoneList []libdns.Zone
+
+func (l zoneList) ListZones(context.Context) ([]libdns.Zone, error) { return l, nil }
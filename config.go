@@ -0,0 +1,987 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings that can be given in a config file. Flags given
+// on the command line override the values from the file.
+type Config struct {
+	Domains     []DomainConfig `yaml:"domains"`
+	RecordTypes []string       `yaml:"record_types"`
+	TTL         recordTTL      `yaml:"ttl"`
+	// SyncTTL rewrites records whose TTL was changed elsewhere.
+	SyncTTL bool `yaml:"sync_ttl"`
+	Proxied bool `yaml:"proxied"`
+	// SyncProxied rewrites records whose proxying was changed elsewhere.
+	SyncProxied bool `yaml:"sync_proxied"`
+	// ManagePTR also keeps the PTR records of the detected addresses
+	// pointed at the domains, in reverse zones hosted in the account.
+	ManagePTR bool `yaml:"manage_ptr"`
+	// CNAMETarget and TXTValue are the values published for CNAME and TXT
+	// records, which aren't detected.
+	CNAMETarget string `yaml:"cname_target"`
+	TXTValue    string `yaml:"txt_value"`
+	// The SRV settings describe the SRV records published at
+	// _service._proto within each domain, pointing at the domain itself.
+	SRVService  string `yaml:"srv_service"`
+	SRVProto    string `yaml:"srv_proto"`
+	SRVPort     int    `yaml:"srv_port"`
+	SRVPriority int    `yaml:"srv_priority"`
+	SRVWeight   int    `yaml:"srv_weight"`
+	// Op is "set" to replace the other values of the records, "append" to
+	// only add the missing ones, or "create" to only create the records of
+	// names and types that have none.
+	Op string `yaml:"op"`
+	// OnMissing is "create", "warn" or "fail", for what happens to records
+	// that don't exist yet.
+	OnMissing string `yaml:"on_missing"`
+	// Mode is "once" or "watch". If empty, it is "watch" when Interval is
+	// set and "once" otherwise.
+	Mode     string        `yaml:"mode"`
+	Interval time.Duration `yaml:"interval"`
+	// MaxBackoff is the longest that watch mode waits between updates
+	// after repeated failures.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// StartupJitter is the longest that watch mode waits at random before
+	// the first update, so that many hosts restarting together don't
+	// update together.
+	StartupJitter time.Duration `yaml:"startup_jitter"`
+	// Debounce is how long a changed address must stay the same before
+	// watch mode publishes it.
+	Debounce time.Duration `yaml:"debounce"`
+	// WatchNetlink updates as soon as the addresses of Interface, or of
+	// any interface, change, with Interval as a fallback.
+	WatchNetlink bool `yaml:"watch_netlink"`
+	// Timeout bounds the whole run in once mode.
+	Timeout   time.Duration `yaml:"timeout"`
+	IPSources []string      `yaml:"ip_sources"`
+	// Quorum, if more than 1, is how many of IPSources must agree on an
+	// address for it to be published.
+	Quorum int `yaml:"quorum"`
+	// IPSourceWeights, if set, has one weight for each of IPSources, and
+	// makes each detection try them in a random order weighted by them.
+	IPSourceWeights []int `yaml:"ip_source_weights"`
+	// IPCommand, if set, is a shell command that prints the address to
+	// publish, used instead of IPSources.
+	IPCommand        string        `yaml:"ip_command"`
+	IPCommandTimeout time.Duration `yaml:"ip_command_timeout"`
+	// TraceURL is the endpoint read by the trace source. It must use https
+	// unless AllowHTTPTrace is set.
+	TraceURL       string `yaml:"trace_url"`
+	AllowHTTPTrace bool   `yaml:"allow_http_trace"`
+	// STUNServer is the host:port queried by the stun source.
+	STUNServer  string        `yaml:"stun_server"`
+	HTTPTimeout time.Duration `yaml:"http_timeout"`
+	// DetectCacheTTL, if non-zero, is how long detected addresses are
+	// reused by later updates instead of detecting them again.
+	DetectCacheTTL time.Duration `yaml:"detect_cache_ttl"`
+	// BreakerThreshold, if non-zero, is how many times in a row an ip
+	// source of several can fail before it's skipped for BreakerCooldown.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+	// UserAgent is sent with the detection requests.
+	UserAgent string `yaml:"user_agent"`
+	// AllowPrivate allows publishing private, loopback, link-local and
+	// CGNAT addresses, which are skipped otherwise.
+	AllowPrivate bool `yaml:"allow_private"`
+	// AllowCIDRs, if not empty, are the only ranges that addresses are
+	// published from.
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	// RequireConsistent publishes nothing if only one of A and AAAA
+	// addresses are detected when both are wanted.
+	RequireConsistent bool   `yaml:"require_consistent"`
+	Resolver          string `yaml:"resolver"`
+	// Bind4 and Bind6 are the local address or interface that addresses
+	// are detected from, for each family.
+	Bind4 string `yaml:"bind4"`
+	Bind6 string `yaml:"bind6"`
+	// Interface is the interface that addresses of both families are
+	// detected from, unless Bind4 or Bind6 is set.
+	Interface string `yaml:"interface"`
+	// NoProxy makes detection ignore the proxy set in the environment.
+	NoProxy bool `yaml:"no_proxy"`
+	// DetectFallback retries detection over any address family if
+	// connecting over the one of the record type fails.
+	DetectFallback bool `yaml:"detect_fallback"`
+	// V6Suffix, if set, is the interface identifier that replaces the low
+	// 64 bits of detected AAAA addresses, to publish another host on the
+	// delegated prefix.
+	V6Suffix   string `yaml:"v6_suffix"`
+	MaxRetries int    `yaml:"max_retries"`
+	// ReadTimeout bounds reading the existing records of a zone, including
+	// retries, so that a slow read leaves time for the writes.
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// Concurrency is the most zones updated at once.
+	Concurrency int `yaml:"concurrency"`
+	// RateLimit is the most requests per second made to the provider.
+	RateLimit   float64 `yaml:"rate_limit"`
+	MetricsAddr string  `yaml:"metrics_addr"`
+	// HealthStaleness is how long after the last successful update the
+	// health check starts failing. It defaults to three intervals.
+	HealthStaleness time.Duration `yaml:"health_staleness"`
+	// HistorySize is how many recent address changes /history keeps.
+	HistorySize int    `yaml:"history_size"`
+	StateFile   string `yaml:"state_file"`
+	// Verify looks the changed records up after each run until they have
+	// their new values, for up to VerifyWindow, logging those that don't.
+	// They are looked up with VerifyResolver if it's set, and otherwise on
+	// an authoritative server of their zone.
+	Verify         bool          `yaml:"verify"`
+	VerifyResolver string        `yaml:"verify_resolver"`
+	VerifyWindow   time.Duration `yaml:"verify_window"`
+	// ControlSocket, if set, is the path of a Unix socket that local tools
+	// can query the status on and start updates through in watch mode.
+	ControlSocket string `yaml:"control_socket"`
+	// LockFile, if set, is locked for the whole run, so that only one
+	// instance runs at a time. LockWait is how long to wait for another
+	// instance to release it.
+	LockFile string        `yaml:"lock_file"`
+	LockWait time.Duration `yaml:"lock_wait"`
+	// Comment is given to the records that are written, with {time}
+	// replaced by the time of the write. Only Cloudflare supports it.
+	Comment string `yaml:"comment"`
+	// NotifyWebhook is a URL to post a JSON notification to whenever a
+	// record changes.
+	NotifyWebhook string `yaml:"notify_webhook"`
+	// PreHook is a shell command run before each record is changed. If it
+	// fails, the record is left as it is. PostHook is run after each
+	// change, and its failures are only logged.
+	PreHook  string `yaml:"pre_hook"`
+	PostHook string `yaml:"post_hook"`
+	// PingURL, if set, is fetched after every successful run, for a dead
+	// man's switch monitor. With PingFail, its /fail variant is fetched
+	// after a failed run.
+	PingURL  string `yaml:"ping_url"`
+	PingFail bool   `yaml:"ping_fail"`
+	// SMTPServer, if set, is the host:port of an SMTP server to email a
+	// summary of each run through, when it changed a record or failed, or
+	// after every run with SMTPAlways. The password for SMTPUser is read
+	// from SMTPPasswordFile, or else the SMTP_PASSWORD env var.
+	SMTPServer       string     `yaml:"smtp_server"`
+	SMTPFrom         string     `yaml:"smtp_from"`
+	SMTPTo           []string   `yaml:"smtp_to"`
+	SMTPUser         string     `yaml:"smtp_user"`
+	SMTPPasswordFile string     `yaml:"smtp_password_file"`
+	SMTPAlways       bool       `yaml:"smtp_always"`
+	LogFormat        string     `yaml:"log_format"`
+	LogLevel         slog.Level `yaml:"log_level"`
+	// Provider is the DNS hosting service, one of the keys of backends.
+	Provider string `yaml:"provider"`
+	// APITokenEnv is the environment variable holding the API token. It
+	// defaults to the one used by the provider.
+	APITokenEnv string `yaml:"api_token_env"`
+	// APITokenFile is a file holding the API token. It takes precedence
+	// over APITokenEnv, and defaults to the file named by APITokenEnv with a
+	// _FILE suffix.
+	APITokenFile string `yaml:"api_token_file"`
+	// Profiles are named credentials for other accounts of the provider,
+	// which domains can refer to.
+	Profiles map[string]ProfileConfig `yaml:"profiles"`
+
+	// ttlSet is whether TTL was given explicitly, rather than being the
+	// default.
+	ttlSet bool
+}
+
+// DomainConfig is an entry of Config.Domains. Its settings override the
+// global ones when set. In the config file, an entry can also be just the
+// name.
+type DomainConfig struct {
+	Name        string    `yaml:"name"`
+	TTL         recordTTL `yaml:"ttl"`
+	Proxied     *bool     `yaml:"proxied"`
+	RecordTypes []string  `yaml:"record_types"`
+	// Profile is the key of Config.Profiles whose credentials are used for
+	// the domain, or empty for the global ones.
+	Profile string `yaml:"profile"`
+}
+
+// ProfileConfig is an entry of Config.Profiles. Unlike the global settings,
+// it has no default token environment variable, so one of the fields must be
+// set.
+type ProfileConfig struct {
+	APITokenEnv  string `yaml:"api_token_env"`
+	APITokenFile string `yaml:"api_token_file"`
+}
+
+func (d *DomainConfig) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&d.Name)
+	}
+	// Decoding a node doesn't inherit the decoder's strictness, so check
+	// for unknown keys here.
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			switch k := n.Content[i]; k.Value {
+			case "name", "ttl", "proxied", "record_types", "profile":
+			default:
+				return fmt.Errorf("line %d: field %v not found in domain", k.Line, k.Value)
+			}
+		}
+	}
+	type plain DomainConfig
+	return n.Decode((*plain)(d))
+}
+
+// nameData is what the templates of domain names can refer to.
+type nameData struct {
+	// Hostname is the first label of the host name of this machine.
+	Hostname string
+	// Date is today's date in UTC, like 20060102.
+	Date string
+}
+
+// expandName executes the domain name template tmpl, checking that the result
+// is a valid DNS name.
+func expandName(tmpl string) (string, error) {
+	t, err := template.New("name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("could not get the host name: %w", err)
+	}
+	host, _, _ = strings.Cut(host, ".")
+	data := nameData{Hostname: strings.ToLower(host), Date: time.Now().UTC().Format("20060102")}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("could not expand name template: %w", err)
+	}
+	name := b.String()
+	if err := checkDNSName(name); err != nil {
+		return "", fmt.Errorf("template %q gives an invalid name: %w", tmpl, err)
+	}
+	return name, nil
+}
+
+// dnsLabel matches a label of a host name, or of a service name like _sip.
+var dnsLabel = regexp.MustCompile(`^_?[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// checkDNSName returns an error if name isn't a valid DNS name.
+func checkDNSName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return fmt.Errorf("%q is longer than 253 characters", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabel.MatchString(strings.ToLower(label)) {
+			return fmt.Errorf("%q has an invalid label %q", name, label)
+		}
+	}
+	return nil
+}
+
+// domainNames returns the names of domains.
+func domainNames(domains []DomainConfig) []string {
+	names := make([]string, len(domains))
+	for i, d := range domains {
+		names[i] = d.Name
+	}
+	return names
+}
+
+// readDomains reads one domain per line from r, skipping blank lines and
+// lines starting with #.
+func readDomains(r io.Reader) ([]string, error) {
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+// defaultConfig returns the settings used when neither a flag nor the config
+// file sets them.
+func defaultConfig() Config {
+	return Config{
+		RecordTypes: []string{"A", "AAAA"},
+		Op:          "set",
+		OnMissing:   "create",
+		TTL:         recordTTL(5 * time.Minute),
+		IPSources:   []string{"trace"},
+		TraceURL:    ddns.DefaultTraceURL,
+		STUNServer:  ddns.DefaultSTUNServer,
+		HTTPTimeout: 10 * time.Second,
+		UserAgent:   "dyncf/" + version(),
+		MaxRetries:  3,
+		ReadTimeout: 30 * time.Second,
+		MaxBackoff:  time.Hour,
+		RateLimit:   2,
+		Concurrency: 4,
+		HistorySize: 100,
+		Comment:     "managed by dyncf, updated {time}",
+		LogFormat:   "text",
+		LogLevel:    slog.LevelInfo,
+		Provider:    "cloudflare",
+
+		IPCommandTimeout: 30 * time.Second,
+		BreakerThreshold: 3,
+		BreakerCooldown:  10 * time.Minute,
+		VerifyWindow:     2 * time.Minute,
+	}
+}
+
+// registerFlags defines flags on fs that set the fields of c.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.Var(domainsFlag{&c.Domains}, "dns-domain", "Comma-separated list of domains to update")
+	fs.StringVar(&c.Mode, "mode", c.Mode, "once to update the records and exit, or watch to keep them updated every -interval (default: watch if -interval is set)")
+	fs.StringVar(&c.Op, "op", c.Op, "set to replace the other values of the records, deleting those no longer detected, append to only add missing values and keep the others, or create to only create records whose name and type have none")
+	fs.StringVar(&c.OnMissing, "on-missing", c.OnMissing, "create the records that don't exist yet, warn to also log a warning, or fail to fail them instead, e.g. to catch records that vanished")
+	fs.BoolFunc("create-only", "Same as -op create", func(string) error {
+		c.Op = "create"
+		return nil
+	})
+	fs.DurationVar(&c.Interval, "interval", c.Interval, "How often to update the records in watch mode")
+	fs.DurationVar(&c.MaxBackoff, "max-backoff", c.MaxBackoff, "Longest wait between updates in watch mode after repeated failures")
+	fs.BoolVar(&c.WatchNetlink, "watch-netlink", c.WatchNetlink, "In watch mode, also update as soon as the addresses of -interface, or of any interface, change; Linux only, and -interval can then be long")
+	fs.DurationVar(&c.Debounce, "debounce", c.Debounce, "In watch mode, only publish a changed address once it has been detected unchanged for this long; use an -interval shorter than this")
+	fs.DurationVar(&c.StartupJitter, "startup-jitter", c.StartupJitter, "In watch mode, wait a random time up to this long before the first update")
+	fs.DurationVar(&c.Timeout, "timeout", c.Timeout, "If non-zero, give up on the whole run after this long in once mode")
+	fs.Var(listFlag{&c.RecordTypes}, "record-types", "Comma-separated list of record types to update: A, AAAA, CNAME, TXT or SRV")
+	fs.StringVar(&c.CNAMETarget, "cname-target", c.CNAMETarget, "Host name that CNAME records point at")
+	fs.StringVar(&c.TXTValue, "txt-value", c.TXTValue, "Value of TXT records")
+	fs.StringVar(&c.SRVService, "srv-service", c.SRVService, "Service of SRV records, such as minecraft; they are published at _service._proto within each domain and point at the domain")
+	fs.StringVar(&c.SRVProto, "srv-proto", c.SRVProto, "Protocol of SRV records: tcp or udp")
+	fs.IntVar(&c.SRVPort, "srv-port", c.SRVPort, "Port that SRV records point at")
+	fs.IntVar(&c.SRVPriority, "srv-priority", c.SRVPriority, "Priority of SRV records")
+	fs.IntVar(&c.SRVWeight, "srv-weight", c.SRVWeight, "Weight of SRV records")
+	fs.Var(&repeatedListFlag{list: &c.IPSources}, "ip-source", "Comma-separated list of sources to detect addresses with, tried in order: trace, ipify, stun, or a URL returning a bare address; can be repeated")
+	fs.Var(intListFlag{&c.IPSourceWeights}, "ip-source-weights", "If set, comma-separated weights, one for each ip source, to try the sources in a random order in which each comes first with a chance proportional to its weight; 0 only falls back to a source")
+	fs.IntVar(&c.Quorum, "quorum", c.Quorum, "If more than 1, query all the ip sources at once and only publish an address that this many of them agree on")
+	fs.StringVar(&c.IPCommand, "ip-command", c.IPCommand, "If set, shell command that prints the address to publish, with DYNCF_TYPE set to A or AAAA, used instead of -ip-source")
+	fs.DurationVar(&c.IPCommandTimeout, "ip-command-timeout", c.IPCommandTimeout, "If non-zero, kill -ip-command after this long and treat it as a failed detection")
+	fs.StringVar(&c.TraceURL, "trace-url", c.TraceURL, "Cloudflare style trace endpoint read by the trace ip source")
+	fs.StringVar(&c.STUNServer, "stun-server", c.STUNServer, "STUN server as host:port queried by the stun ip source")
+	fs.BoolVar(&c.AllowHTTPTrace, "allow-http-trace", c.AllowHTTPTrace, "Allow -trace-url to use plain http")
+	fs.DurationVar(&c.HTTPTimeout, "http-timeout", c.HTTPTimeout, "Timeout for each address detection request")
+	fs.DurationVar(&c.DetectCacheTTL, "detect-cache-ttl", c.DetectCacheTTL, "If non-zero, reuse detected addresses for this long instead of detecting them for every update in watch mode")
+	fs.IntVar(&c.BreakerThreshold, "breaker-threshold", c.BreakerThreshold, "If non-zero, skip an ip source of several for -breaker-cooldown after it fails this many times in a row")
+	fs.DurationVar(&c.BreakerCooldown, "breaker-cooldown", c.BreakerCooldown, "How long a failing ip source is skipped before it's tried again")
+	fs.StringVar(&c.UserAgent, "user-agent", c.UserAgent, "User-Agent sent with the address detection requests")
+	fs.Var(appendFlag{&c.AllowCIDRs}, "allow-cidr", "Only publish addresses in this range; can be repeated or comma-separated, and adds to allow_cidrs from the config file")
+	fs.BoolVar(&c.AllowPrivate, "allow-private", c.AllowPrivate, "Publish addresses that aren't reachable from the internet, like private or CGNAT addresses")
+	fs.BoolVar(&c.RequireConsistent, "require-consistent", c.RequireConsistent, "If both A and AAAA records are wanted but only one family is detected, publish nothing instead of only warning")
+	fs.StringVar(&c.Resolver, "resolver", c.Resolver, "If set, DNS server such as 1.1.1.1:53 used to look up the ip sources instead of the system resolver")
+	fs.StringVar(&c.Bind4, "bind4", c.Bind4, "If set, local IPv4 address or interface to detect the A address from")
+	fs.StringVar(&c.Interface, "interface", c.Interface, "If set, network interface such as eth1 to detect the addresses from, using its address of the family of each record type")
+	fs.StringVar(&c.Bind6, "bind6", c.Bind6, "If set, local IPv6 address or interface to detect the AAAA address from, e.g. to avoid a temporary address")
+	fs.BoolVar(&c.DetectFallback, "detect-fallback", c.DetectFallback, "If connecting over the family of a record type fails, retry detection over any family, only accepting an address of the right family")
+	fs.BoolVar(&c.NoProxy, "no-proxy", c.NoProxy, "Detect addresses directly instead of through the proxy set by HTTP_PROXY and HTTPS_PROXY")
+	fs.StringVar(&c.V6Suffix, "v6-suffix", c.V6Suffix, "If set, interface identifier such as ::1234 combined with the detected /64 prefix to form the AAAA address of another host")
+	fs.Var(&c.TTL, "ttl", "TTL of the records, or auto for Cloudflare's automatic TTL")
+	fs.BoolVar(&c.SyncTTL, "sync-ttl", c.SyncTTL, "Also rewrite records whose TTL differs from -ttl, instead of only comparing their values")
+	fs.StringVar(&c.Comment, "comment", c.Comment, "Comment set on the Cloudflare records that are written, with {time} replaced by the time of the write; empty for none")
+	fs.BoolVar(&c.Proxied, "proxied", c.Proxied, "Enable Cloudflare's proxy on the records that are written")
+	fs.BoolVar(&c.SyncProxied, "sync-proxied", c.SyncProxied, "Also rewrite records whose proxying differs from -proxied, instead of keeping the proxying of existing records that aren't -proxied")
+	fs.BoolVar(&c.ManagePTR, "manage-ptr", c.ManagePTR, "Also point the PTR records of the detected addresses at the domains, in the in-addr.arpa or ip6.arpa zones delegated to the account")
+	fs.IntVar(&c.MaxRetries, "max-retries", c.MaxRetries, "How many times to retry updating records after a transient failure")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "If non-zero, give up reading the existing records of a zone after this long, including retries; in watch mode the records are then written without comparing")
+	fs.IntVar(&c.Concurrency, "concurrency", c.Concurrency, "Most zones updated at once; requests are still limited by -rate-limit")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "Most API requests per second made to the DNS provider")
+	fs.DurationVar(&c.HealthStaleness, "health-staleness", c.HealthStaleness, "How long after the last successful update /healthz starts failing (default: 3 intervals)")
+	fs.IntVar(&c.HistorySize, "history-size", c.HistorySize, "How many recent address changes the /history endpoint of -metrics-addr keeps")
+	fs.BoolVar(&c.Verify, "verify", c.Verify, "After each run, look up the changed A, AAAA and TXT records until they resolve to their new values, warning about those that don't within -verify-window")
+	fs.StringVar(&c.VerifyResolver, "verify-resolver", c.VerifyResolver, "If set, DNS server such as 1.1.1.1:53 that -verify looks the records up on, instead of an authoritative server of their zone")
+	fs.DurationVar(&c.VerifyWindow, "verify-window", c.VerifyWindow, "How long -verify waits for the changed records to resolve to their new values")
+	fs.StringVar(&c.ControlSocket, "control-socket", c.ControlSocket, "If set, path of a Unix socket that answers status and kick commands in watch mode")
+	fs.StringVar(&c.LockFile, "lock-file", c.LockFile, "If set, lock this file for the whole run and exit with 1 if another instance holds it")
+	fs.DurationVar(&c.LockWait, "lock-wait", c.LockWait, "How long to wait for another instance to release -lock-file before giving up")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "If set, remember the published addresses in this file and skip the API when they haven't changed")
+	fs.StringVar(&c.NotifyWebhook, "notify-webhook", c.NotifyWebhook, "If set, POST a JSON notification to this URL whenever a record changes")
+	fs.StringVar(&c.PreHook, "pre-hook", c.PreHook, "If set, shell command run before each record is changed, with DYNCF_DOMAIN, DYNCF_TYPE, DYNCF_OLD and DYNCF_NEW set; the record is left as it is if it fails")
+	fs.StringVar(&c.PostHook, "post-hook", c.PostHook, "If set, shell command run after each record is changed, with the same environment as -pre-hook")
+	fs.StringVar(&c.PingURL, "ping-url", c.PingURL, "If set, URL to GET after every successful run, e.g. of a healthchecks.io check")
+	fs.BoolVar(&c.PingFail, "ping-fail", c.PingFail, "After a failed run, GET -ping-url with /fail appended instead of skipping the ping")
+	fs.StringVar(&c.SMTPServer, "smtp-server", c.SMTPServer, "If set, host:port of an SMTP server to email a summary of each run through when it changes a record or fails")
+	fs.StringVar(&c.SMTPFrom, "smtp-from", c.SMTPFrom, "Sender of the summary emails")
+	fs.Var(listFlag{&c.SMTPTo}, "smtp-to", "Comma-separated list of recipients of the summary emails")
+	fs.StringVar(&c.SMTPUser, "smtp-user", c.SMTPUser, "If set, user to authenticate to the SMTP server as, with the password from -smtp-password-file or the SMTP_PASSWORD env var")
+	fs.StringVar(&c.SMTPPasswordFile, "smtp-password-file", c.SMTPPasswordFile, "File to read the SMTP password from instead of the environment")
+	fs.BoolVar(&c.SMTPAlways, "smtp-always", c.SMTPAlways, "Email a summary after every run, even if nothing changed")
+	fs.StringVar(&c.Provider, "provider", c.Provider, "DNS provider to update the records with: cloudflare or desec")
+	fs.StringVar(&c.APITokenFile, "token-file", c.APITokenFile, "File to read the API token from instead of the environment")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Format of the logs: text or json")
+	fs.TextVar(&c.LogLevel, "log-level", c.LogLevel, "Minimum level of the logs: debug, info, warn or error")
+	fs.BoolFunc("verbose", "Log at debug level, including the detection and API responses; same as -log-level debug", func(s string) error {
+		// -verbose=false leaves the level as it is.
+		on, err := strconv.ParseBool(s)
+		if on {
+			c.LogLevel = slog.LevelDebug
+		}
+		return err
+	})
+	fs.BoolFunc("quiet", "Only log warnings and errors, so that a successful run prints nothing, e.g. from cron; same as -log-level warn", func(s string) error {
+		on, err := strconv.ParseBool(s)
+		if on {
+			c.LogLevel = slog.LevelWarn
+		}
+		return err
+	})
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "If set, serve Prometheus metrics on this address in daemon mode")
+}
+
+// load reads the YAML file at path into c. Keys missing from the file keep
+// their current value, and unknown keys are an error.
+func (c *Config) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("could not parse %v: %w", path, err)
+	}
+	var keys map[string]any
+	if err := yaml.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("could not parse %v: %w", path, err)
+	}
+	if _, ok := keys["ttl"]; ok {
+		c.ttlSet = true
+	}
+	return nil
+}
+
+// validate checks that c is complete and consistent, normalizing values where
+// needed.
+func (c *Config) validate() error {
+	var errs []error
+	if len(c.RecordTypes) == 0 {
+		errs = append(errs, errors.New("no record types given"))
+	}
+	errs = append(errs, c.checkRecordTypes(c.RecordTypes)...)
+	c.CNAMETarget = strings.TrimSuffix(c.CNAMETarget, ".")
+	c.SRVService = strings.TrimPrefix(c.SRVService, "_")
+	c.SRVProto = strings.TrimPrefix(c.SRVProto, "_")
+	errs = append(errs, c.checkTTL(c.TTL, c.Proxied)...)
+	for i := range c.Domains {
+		d := &c.Domains[i]
+		var derrs []error
+		if d.Name == "" {
+			derrs = append(derrs, errors.New("no name given"))
+		}
+		if strings.Contains(d.Name, "{{") {
+			name, err := expandName(d.Name)
+			if err != nil {
+				derrs = append(derrs, err)
+			} else {
+				d.Name = name
+			}
+		}
+		if name, err := ddns.ToASCII(d.Name); err != nil {
+			derrs = append(derrs, err)
+		} else {
+			d.Name = name
+		}
+		proxied := c.Proxied
+		if d.Proxied != nil {
+			proxied = *d.Proxied
+		}
+		switch {
+		case d.TTL != 0:
+			derrs = append(derrs, c.checkTTL(d.TTL, proxied)...)
+		case c.Proxied && !proxied:
+			// The global TTL was only checked for proxied records.
+			derrs = append(derrs, c.checkTTL(c.TTL, false)...)
+		}
+		derrs = append(derrs, c.checkRecordTypes(d.RecordTypes)...)
+		if d.Proxied != nil && *d.Proxied && c.Provider != "cloudflare" {
+			derrs = append(derrs, errors.New("proxied records are only supported by cloudflare"))
+		}
+		if _, ok := c.Profiles[d.Profile]; d.Profile != "" && !ok {
+			derrs = append(derrs, fmt.Errorf("unknown profile %q", d.Profile))
+		}
+		if err := errors.Join(derrs...); err != nil {
+			errs = append(errs, fmt.Errorf("domain %d (%v): %w", i+1, d.Name, err))
+		}
+	}
+	if c.Op != "set" && c.Op != "append" && c.Op != "create" {
+		errs = append(errs, fmt.Errorf("unknown op %q", c.Op))
+	}
+	switch c.OnMissing {
+	case ddns.MissingCreate, ddns.MissingWarn:
+	case ddns.MissingFail:
+		if c.Op == "create" {
+			errs = append(errs, errors.New("on missing fail can't be used with op create, which only creates missing records"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown on missing %q, expected create, warn or fail", c.OnMissing))
+	}
+	if c.Interval < 0 {
+		errs = append(errs, fmt.Errorf("interval must not be negative, got %v", c.Interval))
+	}
+	switch c.Mode {
+	case "":
+	case "once":
+		if c.Interval != 0 {
+			errs = append(errs, fmt.Errorf("once mode doesn't use an interval, got %v", c.Interval))
+		}
+	case "watch":
+		if c.Interval == 0 {
+			errs = append(errs, errors.New("watch mode needs an interval"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown mode %q", c.Mode))
+	}
+	if c.Quorum < 0 || c.Quorum > len(c.IPSources) {
+		errs = append(errs, fmt.Errorf("quorum must be between 0 and the number of ip sources, %d, got %v", len(c.IPSources), c.Quorum))
+	}
+	if len(c.IPSources) == 0 {
+		errs = append(errs, errors.New("no ip sources given"))
+	}
+	if len(c.IPSourceWeights) > 0 {
+		if len(c.IPSourceWeights) != len(c.IPSources) {
+			errs = append(errs, fmt.Errorf("need one ip source weight for each of the %d ip sources, got %d", len(c.IPSources), len(c.IPSourceWeights)))
+		}
+		if slices.ContainsFunc(c.IPSourceWeights, func(w int) bool { return w < 0 }) {
+			errs = append(errs, fmt.Errorf("ip source weights must not be negative, got %v", c.IPSourceWeights))
+		}
+		if !slices.ContainsFunc(c.IPSourceWeights, func(w int) bool { return w > 0 }) {
+			errs = append(errs, errors.New("at least one ip source weight must be positive"))
+		}
+		if c.Quorum > 1 {
+			errs = append(errs, errors.New("ip source weights can't be used with a quorum, which queries all the sources"))
+		}
+	}
+	if u, err := url.Parse(c.TraceURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid trace url: %w", err))
+	} else if u.Host == "" || u.Scheme != "https" && !(u.Scheme == "http" && c.AllowHTTPTrace) {
+		errs = append(errs, fmt.Errorf("trace url %q must be an https URL, or http with allow http trace", c.TraceURL))
+	}
+	if _, _, err := net.SplitHostPort(c.STUNServer); err != nil && slices.Contains(c.IPSources, "stun") {
+		errs = append(errs, fmt.Errorf("invalid stun server: %w", err))
+	}
+	for _, cidr := range c.AllowCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allowed range: %w", err))
+		}
+	}
+	if c.V6Suffix != "" {
+		if _, err := ddns.ParseV6Suffix(c.V6Suffix); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for name, p := range c.Profiles {
+		if p.APITokenEnv == "" && p.APITokenFile == "" {
+			errs = append(errs, fmt.Errorf("profile %v has neither api_token_env nor api_token_file", name))
+		}
+	}
+	if c.MaxBackoff < 0 {
+		errs = append(errs, fmt.Errorf("max backoff must not be negative, got %v", c.MaxBackoff))
+	}
+	if c.StartupJitter < 0 {
+		errs = append(errs, fmt.Errorf("startup jitter must not be negative, got %v", c.StartupJitter))
+	}
+	if c.StartupJitter > 0 && !c.watching() {
+		errs = append(errs, errors.New("startup jitter needs watch mode"))
+	}
+	if c.IPCommandTimeout < 0 {
+		errs = append(errs, fmt.Errorf("ip command timeout must not be negative, got %v", c.IPCommandTimeout))
+	}
+	if c.BreakerThreshold < 0 {
+		errs = append(errs, fmt.Errorf("breaker threshold must not be negative, got %v", c.BreakerThreshold))
+	}
+	if c.BreakerCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("breaker cooldown must be positive, got %v", c.BreakerCooldown))
+	}
+	if c.DetectCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("detect cache ttl must not be negative, got %v", c.DetectCacheTTL))
+	}
+	if c.Debounce < 0 {
+		errs = append(errs, fmt.Errorf("debounce must not be negative, got %v", c.Debounce))
+	}
+	if c.Debounce > 0 && !c.watching() {
+		errs = append(errs, errors.New("debounce needs watch mode"))
+	}
+	if c.WatchNetlink && !c.watching() {
+		errs = append(errs, errors.New("watching netlink needs watch mode, whose interval is the fallback"))
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative, got %v", c.Timeout))
+	}
+	if c.Timeout > 0 && c.watching() {
+		errs = append(errs, errors.New("a timeout can't be used in watch mode"))
+	}
+	if c.HealthStaleness < 0 {
+		errs = append(errs, fmt.Errorf("health staleness must not be negative, got %v", c.HealthStaleness))
+	}
+	if c.HealthStaleness == 0 {
+		c.HealthStaleness = 3 * c.Interval
+	}
+	if c.VerifyWindow <= 0 {
+		errs = append(errs, fmt.Errorf("verify window must be positive, got %v", c.VerifyWindow))
+	}
+	if c.LockWait < 0 {
+		errs = append(errs, fmt.Errorf("lock wait must not be negative, got %v", c.LockWait))
+	}
+	if c.HistorySize < 0 {
+		errs = append(errs, fmt.Errorf("history size must not be negative, got %v", c.HistorySize))
+	}
+	if c.ReadTimeout < 0 {
+		errs = append(errs, fmt.Errorf("read timeout must not be negative, got %v", c.ReadTimeout))
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("max retries must not be negative, got %v", c.MaxRetries))
+	}
+	if c.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("concurrency must be at least 1, got %v", c.Concurrency))
+	}
+	if c.RateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("rate limit must be positive, got %v", c.RateLimit))
+	}
+	if c.PingURL != "" {
+		if u, err := url.Parse(c.PingURL); err != nil || u.Host == "" || u.Scheme != "https" && u.Scheme != "http" {
+			errs = append(errs, fmt.Errorf("ping url %q must be an http or https URL", c.PingURL))
+		}
+	} else if c.PingFail {
+		errs = append(errs, errors.New("ping fail needs a ping url"))
+	}
+	if c.SMTPServer != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPServer); err != nil {
+			errs = append(errs, fmt.Errorf("invalid smtp server: %w", err))
+		}
+		if c.SMTPFrom == "" || len(c.SMTPTo) == 0 {
+			errs = append(errs, errors.New("smtp server needs an smtp from and to"))
+		}
+	} else if c.SMTPFrom != "" || len(c.SMTPTo) > 0 || c.SMTPUser != "" || c.SMTPPasswordFile != "" || c.SMTPAlways {
+		errs = append(errs, errors.New("smtp settings need an smtp server"))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("unsupported log format %q", c.LogFormat))
+	}
+	if b, ok := backends[c.Provider]; !ok {
+		errs = append(errs, fmt.Errorf("unknown provider %q", c.Provider))
+	} else if c.APITokenEnv == "" {
+		c.APITokenEnv = b.tokenEnv
+	}
+	if c.Proxied && c.Provider != "cloudflare" {
+		errs = append(errs, errors.New("proxied records are only supported by cloudflare"))
+	}
+	if c.SyncProxied && c.Provider != "cloudflare" {
+		errs = append(errs, errors.New("syncing proxying is only supported by cloudflare"))
+	}
+	if c.ManagePTR && c.Provider != "cloudflare" {
+		errs = append(errs, errors.New("managing PTR records needs a provider that can list zones, which only cloudflare can"))
+	}
+	return errors.Join(errs...)
+}
+
+// checkRecordTypes checks that types are supported and have the values they
+// need, normalizing them to upper case.
+func (c *Config) checkRecordTypes(types []string) []error {
+	var errs []error
+	for i, t := range types {
+		t = strings.ToUpper(t)
+		switch t {
+		case "A", "AAAA":
+		case "CNAME":
+			if c.CNAMETarget == "" {
+				errs = append(errs, errors.New("CNAME records need a cname target"))
+			}
+			if len(types) > 1 {
+				errs = append(errs, errors.New("CNAME records can't be combined with other record types"))
+			}
+		case "TXT":
+			if c.TXTValue == "" {
+				errs = append(errs, errors.New("TXT records need a txt value"))
+			}
+		case "SRV":
+			if c.SRVService == "" || c.SRVProto == "" {
+				errs = append(errs, errors.New("SRV records need an srv service and proto"))
+			}
+			if c.SRVPort < 1 || c.SRVPort > 65535 {
+				errs = append(errs, fmt.Errorf("srv port must be between 1 and 65535, got %v", c.SRVPort))
+			}
+			if c.SRVPriority < 0 || c.SRVPriority > 65535 {
+				errs = append(errs, fmt.Errorf("srv priority must be between 0 and 65535, got %v", c.SRVPriority))
+			}
+			if c.SRVWeight < 0 || c.SRVWeight > 65535 {
+				errs = append(errs, fmt.Errorf("srv weight must be between 0 and 65535, got %v", c.SRVWeight))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unsupported record type %q", t))
+		}
+		types[i] = t
+	}
+	return errs
+}
+
+// allRecordTypes returns the record types used by any domain, in the order
+// they first appear.
+func (c *Config) allRecordTypes() []string {
+	types := slices.Clone(c.RecordTypes)
+	for _, d := range c.Domains {
+		for _, t := range d.RecordTypes {
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+	return types
+}
+
+// watching reports whether the records should be kept updated continuously.
+func (c *Config) watching() bool {
+	return c.Mode == "watch" || c.Mode == "" && c.Interval != 0
+}
+
+// apiToken returns the API token, preferring a file over the environment.
+func (c *Config) apiToken() (string, error) {
+	return readToken(c.APITokenFile, c.APITokenEnv)
+}
+
+// token returns the API token of the profile, preferring a file over the
+// environment.
+func (p ProfileConfig) token() (string, error) {
+	return readToken(p.APITokenFile, p.APITokenEnv)
+}
+
+// readToken reads an API token from the file at path, or the file named by
+// the env variable with a _FILE suffix, or else from env itself.
+func readToken(path, env string) (string, error) {
+	if path == "" && env != "" {
+		path = os.Getenv(env + "_FILE")
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read api token: %w", err)
+		}
+		token := strings.TrimRightFunc(string(b), unicode.IsSpace)
+		if token == "" {
+			return "", fmt.Errorf("api token file %v is empty", path)
+		}
+		slog.Info("read api token from file", "path", path)
+		return token, nil
+	}
+	token := os.Getenv(env)
+	if token == "" {
+		return "", fmt.Errorf("%v env var is missing", env)
+	}
+	slog.Info("read api token from environment", "var", env)
+	return token, nil
+}
+
+// domainsFlag is a flag holding a comma-separated list of domain names.
+// Setting it replaces the whole list.
+type domainsFlag struct {
+	list *[]DomainConfig
+}
+
+func (f domainsFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(domainNames(*f.list), ",")
+}
+
+func (f domainsFlag) Set(s string) error {
+	var names []string
+	if err := (listFlag{&names}).Set(s); err != nil {
+		return err
+	}
+	*f.list = nil
+	for _, name := range names {
+		*f.list = append(*f.list, DomainConfig{Name: name})
+	}
+	return nil
+}
+
+// recordTTL is the TTL of records, which is ddns.AutoTTL when it's given as
+// "auto".
+type recordTTL time.Duration
+
+func (t recordTTL) String() string {
+	if t == autoTTL {
+		return "auto"
+	}
+	return time.Duration(t).String()
+}
+
+func (t *recordTTL) Set(s string) error {
+	if s == "auto" {
+		*t = autoTTL
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*t = recordTTL(d)
+	return nil
+}
+
+func (t *recordTTL) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	if err := t.Set(s); err != nil {
+		return fmt.Errorf("line %d: invalid ttl %q", n.Line, s)
+	}
+	return nil
+}
+
+func (t recordTTL) MarshalYAML() (any, error) {
+	return t.String(), nil
+}
+
+// autoTTL is the recordTTL of "auto".
+const autoTTL = recordTTL(ddns.AutoTTL)
+
+// checkTTL returns the problems with the TTL t of records that are proxied
+// or not.
+func (c *Config) checkTTL(t recordTTL, proxied bool) []error {
+	if t == autoTTL {
+		if c.Provider != "cloudflare" {
+			return []error{errors.New("ttl auto is only supported by cloudflare")}
+		}
+		return nil
+	}
+	minTTL := ddns.MinTTL
+	if proxied && c.Provider == "cloudflare" {
+		// Cloudflare ignores the TTL of proxied records, so its minimum
+		// doesn't apply.
+		minTTL = time.Second
+	}
+	if d := time.Duration(t); d < minTTL || d > ddns.MaxTTL {
+		return []error{fmt.Errorf("ttl must be between %v and %v or auto, got %v", minTTL, ddns.MaxTTL, d)}
+	}
+	return nil
+}
+
+// appendFlag is a flag holding a list that each use of the flag adds
+// comma-separated values to, skipping values already in the list.
+type appendFlag struct {
+	list *[]string
+}
+
+func (f appendFlag) String() string {
+	return listFlag(f).String()
+}
+
+func (f appendFlag) Set(s string) error {
+	var values []string
+	if err := (listFlag{&values}).Set(s); err != nil {
+		return err
+	}
+	for _, v := range values {
+		if !slices.Contains(*f.list, v) {
+			*f.list = append(*f.list, v)
+		}
+	}
+	return nil
+}
+
+// repeatedListFlag is a listFlag that can also be repeated: the first use
+// replaces the list, and later ones add to it.
+type repeatedListFlag struct {
+	list *[]string
+	// last is the list as the flag last set it. If the list is another
+	// one, something else like the config file set it since, and the next
+	// use replaces it again.
+	last []string
+}
+
+func (f *repeatedListFlag) String() string {
+	return listFlag{f.list}.String()
+}
+
+func (f *repeatedListFlag) Set(s string) error {
+	var values []string
+	if err := (listFlag{&values}).Set(s); err != nil {
+		return err
+	}
+	if l := *f.list; len(l) > 0 && len(l) == len(f.last) && &l[0] == &f.last[0] {
+		for _, v := range values {
+			if !slices.Contains(l, v) {
+				l = append(l, v)
+			}
+		}
+		values = l
+	}
+	*f.list = values
+	f.last = values
+	return nil
+}
+
+// listFlag is a flag holding a comma-separated list. Setting it replaces the
+// whole list.
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.list = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f.list = append(*f.list, v)
+		}
+	}
+	return nil
+}
+
+// intListFlag is a listFlag of integers.
+type intListFlag struct {
+	list *[]int
+}
+
+func (f intListFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	values := make([]string, len(*f.list))
+	for i, v := range *f.list {
+		values[i] = strconv.Itoa(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (f intListFlag) Set(s string) error {
+	var values []string
+	if err := (listFlag{&values}).Set(s); err != nil {
+		return err
+	}
+	*f.list = nil
+	for _, v := range values {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*f.list = append(*f.list, n)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateProxiedTTL(t *testing.T) {
+	yes, no := true, false
+	for _, tc := range []struct {
+		name     string
+		provider string
+		proxied  bool
+		domain   DomainConfig
+		wantErr  bool
+	}{
+		{"unproxied", "cloudflare", false, DomainConfig{Name: "home.example.com"}, true},
+		{"proxied", "cloudflare", true, DomainConfig{Name: "home.example.com"}, false},
+		{"proxied domain", "cloudflare", false, DomainConfig{Name: "home.example.com", Proxied: &yes, TTL: recordTTL(30 * time.Second)}, false},
+		{"unproxied domain", "cloudflare", true, DomainConfig{Name: "home.example.com", Proxied: &no}, true},
+		{"unproxied domain with its own ttl", "cloudflare", true, DomainConfig{Name: "home.example.com", Proxied: &no, TTL: recordTTL(time.Hour)}, false},
+		{"desec", "desec", false, DomainConfig{Name: "home.example.com"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Provider = tc.provider
+			cfg.Proxied = tc.proxied
+			cfg.Domains = []DomainConfig{tc.domain}
+			if tc.domain.TTL == 0 {
+				cfg.TTL = recordTTL(30 * time.Second)
+			}
+			err := cfg.validate()
+			switch {
+			case tc.wantErr && (err == nil || !strings.Contains(err.Error(), "ttl must be")):
+				t.Errorf("validate() = %v, want a ttl error", err)
+			case !tc.wantErr && err != nil:
+				t.Errorf("validate() failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlResponse is the reply to a command on the control socket, written
+// as one line of JSON.
+type controlResponse struct {
+	Addresses   map[string][]net.IP `json:"addresses,omitempty"`
+	LastSuccess *time.Time          `json:"last_success,omitempty"`
+	LastError   *time.Time          `json:"last_error,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	NextUpdate  *time.Time          `json:"next_update,omitempty"`
+	// Kicked is set in the reply to kick, and CommandError in the reply
+	// to an unknown command.
+	Kicked       bool   `json:"kicked,omitempty"`
+	CommandError string `json:"command_error,omitempty"`
+}
+
+// serveControl starts serving the control socket at path in the background
+// until ctx is done. Each line sent to it is a command: "status" replies
+// with the addresses detected by the last update, its outcome and when the
+// next one is due, and "kick" sends a value to kicks to update right away. It
+// only returns an error if it can't listen on path.
+func serveControl(ctx context.Context, path string, kicks chan<- struct{}) error {
+	// A socket left behind by a process that didn't shut down cleanly
+	// would make listening fail.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return errors.New("another process is serving " + path)
+		}
+		os.Remove(path)
+	}
+	lis, err := listenControl(path)
+	if err != nil {
+		return err
+	}
+	// Nothing is accepted until the socket is known to be closed to
+	// others.
+	if err := os.Chmod(path, 0o660); err != nil {
+		lis.Close()
+		return fmt.Errorf("could not restrict the permissions of %v: %w", path, err)
+	}
+	context.AfterFunc(ctx, func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("control socket failed", "err", err)
+				}
+				return
+			}
+			go handleControl(conn, kicks)
+		}
+	}()
+	return nil
+}
+
+// handleControl answers the commands sent over conn until it's closed.
+func handleControl(conn net.Conn, kicks chan<- struct{}) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var resp controlResponse
+		switch cmd := strings.TrimSpace(scanner.Text()); cmd {
+		case "":
+			continue
+		case "status":
+			resp = currentStatus()
+		case "kick":
+			select {
+			case kicks <- struct{}{}:
+			default:
+				// An update is already waiting to start.
+			}
+			resp.Kicked = true
+		default:
+			resp.CommandError = "unknown command " + cmd + `, expected "status" or "kick"`
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// currentStatus returns the status of the update cycles.
+func currentStatus() controlResponse {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	resp := controlResponse{Addresses: status.addrs, Error: status.lastErr}
+	if !status.lastSuccess.IsZero() {
+		t := status.lastSuccess
+		resp.LastSuccess = &t
+	}
+	if !status.lastError.IsZero() {
+		t := status.lastError
+		resp.LastError = &t
+	}
+	if !status.next.IsZero() {
+		t := status.next
+		resp.NextUpdate = &t
+	}
+	return resp
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenControl listens on a new Unix socket at path. There is no umask to
+// set outside of Unix, so its permissions are only set once it exists.
+func listenControl(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenControl listens on a new Unix socket at path that only its owner and
+// group can connect to. The umask is set while the socket is created, so
+// there is no moment when others can connect before it's chmodded. The
+// umask is shared by the whole process, which is fine at startup, before
+// anything else creates files.
+func listenControl(path string) (net.Listener, error) {
+	old := syscall.Umask(0o117)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,103 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by a source that is skipped because it failed
+// too often recently.
+var ErrCircuitOpen = errors.New("skipped after repeated failures")
+
+// WithBreakers makes each source of a chain from ParseIPSources be skipped
+// for cooldown once it fails threshold times in a row for a record type, so
+// that detection goes straight to the next source. After the cooldown, one
+// detection tries the source again, which closes the circuit if it succeeds
+// and opens it for another cooldown if it fails. Other sources are returned
+// as they are, since there is nothing to fall through to, and so is source
+// if threshold is zero.
+func WithBreakers(source IPSource, threshold int, cooldown time.Duration) IPSource {
+	chain, ok := source.(sourceChain)
+	if !ok || threshold <= 0 {
+		return source
+	}
+	wrapped := make(sourceChain, len(chain))
+	for i, s := range chain {
+		wrapped[i] = &breakerSource{source: s, threshold: threshold, cooldown: cooldown}
+	}
+	return wrapped
+}
+
+// breakerSource is a source wrapped by WithBreakers.
+type breakerSource struct {
+	source    IPSource
+	threshold int
+	cooldown  time.Duration
+
+	mu     sync.Mutex
+	states map[string]*breakerState
+}
+
+// breakerState is the state of the circuit of one record type.
+type breakerState struct {
+	// failures is the number of failures in a row.
+	failures int
+	// openUntil is the end of the cooldown, or zero if the circuit is
+	// closed.
+	openUntil time.Time
+	// probing is whether a detection is trying the source again after the
+	// cooldown.
+	probing bool
+}
+
+func (s *breakerSource) String() string { return fmt.Sprint(s.source) }
+
+func (s *breakerSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	s.mu.Lock()
+	if s.states == nil {
+		s.states = make(map[string]*breakerState)
+	}
+	st := s.states[recordType]
+	if st == nil {
+		st = &breakerState{}
+		s.states[recordType] = st
+	}
+	if !st.openUntil.IsZero() {
+		if st.probing || time.Now().Before(st.openUntil) {
+			until := st.openUntil
+			s.mu.Unlock()
+			return nil, fmt.Errorf("%w, until %v", ErrCircuitOpen, until.Format(time.TimeOnly))
+		}
+		st.probing = true
+		Logger(ctx).Info("trying ip source again", "source", s.source, "type", recordType)
+	}
+	s.mu.Unlock()
+
+	addr, err := s.source.DetectIP(ctx, recordType)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	probed := st.probing
+	st.probing = false
+	if err == nil {
+		if probed {
+			Logger(ctx).Info("ip source recovered", "source", s.source, "type", recordType)
+		}
+		st.failures, st.openUntil = 0, time.Time{}
+		return addr, nil
+	}
+	// A detection cut short by its caller says nothing about the source.
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	st.failures++
+	if probed || st.failures >= s.threshold {
+		st.openUntil = time.Now().Add(s.cooldown)
+		Logger(ctx).Warn("skipping ip source after repeated failures", "source", s.source, "type", recordType, "failures", st.failures, "until", st.openUntil)
+	}
+	return nil, err
+}
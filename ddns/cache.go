@@ -0,0 +1,65 @@
+package ddns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// CachedSource remembers the addresses detected by Source for each record
+// type for TTL, so that updates close together share one detection. Failures
+// aren't remembered. It's safe for concurrent use.
+type CachedSource struct {
+	Source IPSource
+	TTL    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// cacheEntry is the addresses detected for one record type.
+type cacheEntry struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+func (s *CachedSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	addrs, err := s.DetectIPs(ctx, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+func (s *CachedSource) DetectIPs(ctx context.Context, recordType string) ([]net.IP, error) {
+	s.mu.Lock()
+	e, ok := s.entries[recordType]
+	s.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		Logger(ctx).Debug("using cached addresses", "type", recordType, "addrs", e.addrs, "expires", e.expires)
+		return e.addrs, nil
+	}
+	addrs, err := DetectIPs(ctx, s.Source, recordType)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]cacheEntry)
+	}
+	s.entries[recordType] = cacheEntry{addrs: addrs, expires: time.Now().Add(s.TTL)}
+	return addrs, nil
+}
+
+// Flush forgets all the remembered addresses, e.g. because the network
+// changed. Flushing a nil *CachedSource does nothing.
+func (s *CachedSource) Flush() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.entries)
+}
@@ -0,0 +1,191 @@
+package ddns
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+	"golang.org/x/time/rate"
+)
+
+const cfBaseURL = "https://api.cloudflare.com/client/v4"
+
+var (
+	_ Provider          = (*CloudflareClient)(nil)
+	_ libdns.ZoneLister = (*CloudflareClient)(nil)
+)
+
+// CloudflareClient is a Provider for Cloudflare, which also exposes the
+// settings that libdns doesn't, like the proxied setting of a record.
+// Records are addressed by the ID of their zone, found by name once per zone
+// or given with ZoneName. It implements the records API itself rather than
+// wrapping the libdns cloudflare provider; cfrecords.go says why.
+type CloudflareClient struct {
+	Token string
+	// Limiter is waited on before every request, if set.
+	Limiter *rate.Limiter
+
+	// baseURL replaces cfBaseURL, if set, e.g. for tests.
+	baseURL string
+
+	zoneIDs   map[string]string
+	zoneIDsMu sync.Mutex
+}
+
+// zoneID looks up the ID of the zone with the given name.
+func (c *CloudflareClient) zoneID(ctx context.Context, zone string) (string, error) {
+	c.zoneIDsMu.Lock()
+	defer c.zoneIDsMu.Unlock()
+	if id, ok := c.zoneIDs[zone]; ok {
+		return id, nil
+	}
+
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/zones?"+url.Values{"name": {zone}}.Encode(), nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("zone %s not found; check that the API token has access to it", zone)
+	}
+	if len(zones) != 1 {
+		return "", fmt.Errorf("expected 1 zone, got %d for %s", len(zones), zone)
+	}
+	if c.zoneIDs == nil {
+		c.zoneIDs = make(map[string]string)
+	}
+	c.zoneIDs[zone] = zones[0].ID
+	return zones[0].ID, nil
+}
+
+// ZoneName looks up the name of the zone with ID id, remembering the ID so
+// that the records of the zone are addressed by it and the zone is never
+// looked up by name.
+func (c *CloudflareClient) ZoneName(ctx context.Context, id string) (string, error) {
+	var zone struct {
+		Name string `json:"name"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/zones/"+url.PathEscape(id), nil, &zone); err != nil {
+		return "", err
+	}
+	c.zoneIDsMu.Lock()
+	defer c.zoneIDsMu.Unlock()
+	if c.zoneIDs == nil {
+		c.zoneIDs = make(map[string]string)
+	}
+	c.zoneIDs[zone.Name] = id
+	return zone.Name, nil
+}
+
+// ListZones returns all the zones the token can access.
+func (c *CloudflareClient) ListZones(ctx context.Context) ([]libdns.Zone, error) {
+	const perPage = 50
+	var all []libdns.Zone
+	for page := 1; ; page++ {
+		var zones []struct {
+			Name string `json:"name"`
+		}
+		qs := url.Values{"page": {fmt.Sprint(page)}, "per_page": {fmt.Sprint(perPage)}}
+		if err := c.do(ctx, http.MethodGet, "/zones?"+qs.Encode(), nil, &zones); err != nil {
+			return nil, err
+		}
+		for _, z := range zones {
+			all = append(all, libdns.Zone{Name: z.Name})
+		}
+		if len(zones) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// proxiedRecords returns whether each record in zone is proxied, by ID.
+func (c *CloudflareClient) proxiedRecords(ctx context.Context, zone string) (map[string]bool, error) {
+	records, err := c.listRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	proxied := make(map[string]bool)
+	for _, r := range records {
+		proxied[r.ID] = r.Proxied
+	}
+	return proxied, nil
+}
+
+// patchRecord changes the given fields of the record with ID id in zone.
+func (c *CloudflareClient) patchRecord(ctx context.Context, zone, id string, fields map[string]any) error {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPatch, fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, id), fields, nil)
+}
+
+// do makes an API request, encoding body as the request and decoding the
+// result of the response into result if it's non-nil.
+func (c *CloudflareClient) do(ctx context.Context, method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cmp.Or(c.baseURL, cfBaseURL)+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The request headers hold the token, so only the URL is logged.
+	Logger(ctx).Debug("got api response", "method", method, "url", req.URL.String(), "status", resp.Status)
+
+	var respData struct {
+		Result json.RawMessage `json:"result"`
+		Errors []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	// Error responses such as rate limits may not have a JSON body, and
+	// their status says more than the decoding error.
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil && resp.StatusCode < 400 {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		err := &httpError{StatusCode: resp.StatusCode, msg: fmt.Sprintf("%+v", respData.Errors)}
+		if wait := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); resp.StatusCode == http.StatusTooManyRequests && wait > 0 {
+			return &rateLimitError{retryAfter: wait, err: err}
+		}
+		return err
+	}
+	if len(respData.Errors) > 0 {
+		return fmt.Errorf("got errors: HTTP %d: %+v", resp.StatusCode, respData.Errors)
+	}
+	if result != nil && len(respData.Result) > 0 {
+		return json.Unmarshal(respData.Result, result)
+	}
+	return nil
+}
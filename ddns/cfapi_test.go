@@ -0,0 +1,252 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"golang.org/x/time/rate"
+)
+
+// fakeCloudflare serves the parts of the Cloudflare API that CloudflareClient
+// uses for the zone example.com, whose ID is "zone1". It pages the records
+// like the API does.
+type fakeCloudflare struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	records []cfRecord
+	nextID  int
+	// zoneLookups counts the lookups of the zone by name.
+	zoneLookups int
+}
+
+// newFakeCloudflare starts a fakeCloudflare holding records, and returns a
+// client of it.
+func newFakeCloudflare(t *testing.T, records []cfRecord) (*fakeCloudflare, *CloudflareClient) {
+	t.Helper()
+	f := &fakeCloudflare{t: t, records: records}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /zones", f.zones)
+	mux.HandleFunc("GET /zones/zone1", func(w http.ResponseWriter, r *http.Request) {
+		f.writeResult(w, map[string]string{"id": "zone1", "name": "example.com"})
+	})
+	mux.HandleFunc("GET /zones/zone1/dns_records", f.list)
+	mux.HandleFunc("POST /zones/zone1/dns_records", f.create)
+	mux.HandleFunc("PATCH /zones/zone1/dns_records/{id}", f.update)
+	mux.HandleFunc("DELETE /zones/zone1/dns_records/{id}", f.delete)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, &CloudflareClient{Token: "token", baseURL: srv.URL}
+}
+
+func (f *fakeCloudflare) zones(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.zoneLookups++
+	f.mu.Unlock()
+	if name := r.URL.Query().Get("name"); name != "example.com" {
+		f.writeResult(w, []any{})
+		return
+	}
+	f.writeResult(w, []map[string]string{{"id": "zone1", "name": "example.com"}})
+}
+
+func (f *fakeCloudflare) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query()
+	var matches []cfRecord
+	for _, rec := range f.records {
+		if q.Has("name") && rec.Name != q.Get("name") || q.Has("type") && rec.Type != q.Get("type") || q.Has("content") && rec.Content != q.Get("content") {
+			continue
+		}
+		matches = append(matches, rec)
+	}
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, err := strconv.Atoi(q.Get("per_page"))
+	if err != nil {
+		// The API's default page size.
+		perPage = 100
+	}
+	start := min(len(matches), (max(page, 1)-1)*perPage)
+	f.writeResult(w, matches[start:min(len(matches), start+perPage)])
+}
+
+func (f *fakeCloudflare) create(w http.ResponseWriter, r *http.Request) {
+	var rec cfRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	rec.ID = fmt.Sprint("new", f.nextID)
+	f.records = append(f.records, rec)
+	f.writeResult(w, rec)
+}
+
+func (f *fakeCloudflare) update(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := slices.IndexFunc(f.records, func(rec cfRecord) bool { return rec.ID == r.PathValue("id") })
+	if i < 0 {
+		http.Error(w, `{"success":false,"errors":[{"code":81044,"message":"Record does not exist."}]}`, http.StatusNotFound)
+		return
+	}
+	// Like PATCH, only the fields that are sent are changed.
+	if err := json.NewDecoder(r.Body).Decode(&f.records[i]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.records[i].ID = r.PathValue("id")
+	f.writeResult(w, f.records[i])
+}
+
+func (f *fakeCloudflare) delete(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := slices.IndexFunc(f.records, func(rec cfRecord) bool { return rec.ID == r.PathValue("id") })
+	if i < 0 {
+		http.Error(w, `{"success":false,"errors":[{"code":81044,"message":"Record does not exist."}]}`, http.StatusNotFound)
+		return
+	}
+	f.records = slices.Delete(f.records, i, i+1)
+	f.writeResult(w, map[string]string{"id": r.PathValue("id")})
+}
+
+// writeResult writes result as the result of a successful API response.
+func (f *fakeCloudflare) writeResult(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"success": true, "result": result}); err != nil {
+		f.t.Errorf("could not write response: %v", err)
+	}
+}
+
+func TestGetRecordsPages(t *testing.T) {
+	var records []cfRecord
+	for i := range 250 {
+		records = append(records, cfRecord{ID: fmt.Sprint("id", i), Type: "A", Name: fmt.Sprintf("host%d.example.com", i), Content: "192.0.2.1", TTL: 300})
+	}
+	_, c := newFakeCloudflare(t, records)
+
+	got, err := c.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("GetRecords() failed: %v", err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("GetRecords() returned %d records, want %d", len(got), len(records))
+	}
+	if last := got[len(got)-1]; last.ID != "id249" || last.Name != "host249" {
+		t.Errorf("last record is %+v, want id249 named host249", last)
+	}
+}
+
+func TestGetRecordsSRV(t *testing.T) {
+	_, c := newFakeCloudflare(t, []cfRecord{{
+		ID:      "srv1",
+		Type:    "SRV",
+		Name:    "_minecraft._tcp.example.com",
+		Content: "5 25565 example.com",
+		TTL:     1,
+		Data:    &cfSRVData{Priority: 10, Weight: 5, Port: 25565, Target: "example.com"},
+	}})
+
+	got, err := c.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("GetRecords() failed: %v", err)
+	}
+	want := SRV{Service: "minecraft", Proto: "tcp", Port: 25565, Priority: 10, Weight: 5}.record(Domain{Zone: "example.com", Subdomain: "@", TTL: AutoTTL})
+	want.ID = "srv1"
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("GetRecords() = %+v, want [%+v]", got, want)
+	}
+}
+
+func TestCloudflareWrites(t *testing.T) {
+	ctx := context.Background()
+	f, c := newFakeCloudflare(t, []cfRecord{
+		{ID: "a1", Type: "A", Name: "home.example.com", Content: "192.0.2.1", TTL: 300, Proxied: true},
+		{ID: "txt1", Type: "TXT", Name: "home.example.com", Content: "old", TTL: 300},
+		{ID: "mx1", Type: "MX", Name: "example.com", Content: "mail.example.com", TTL: 300},
+	})
+
+	if _, err := c.SetRecords(ctx, "example.com", []libdns.Record{{ID: "a1", Type: "A", Name: "home", Value: "192.0.2.2", TTL: 5 * time.Minute}}); err != nil {
+		t.Fatalf("SetRecords() by ID failed: %v", err)
+	}
+	if _, err := c.SetRecords(ctx, "example.com", []libdns.Record{{Type: "TXT", Name: "home", Value: "new", TTL: 5 * time.Minute}}); err != nil {
+		t.Fatalf("SetRecords() by name failed: %v", err)
+	}
+	created, err := c.AppendRecords(ctx, "example.com", []libdns.Record{{Type: "AAAA", Name: "@", Value: "2001:db8::1", TTL: 5 * time.Minute}})
+	if err != nil {
+		t.Fatalf("AppendRecords() failed: %v", err)
+	}
+	if len(created) != 1 || created[0].ID == "" || created[0].Name != "" {
+		t.Errorf("AppendRecords() = %+v, want one record at the apex with an ID", created)
+	}
+	if _, err := c.DeleteRecords(ctx, "example.com", []libdns.Record{{Type: "MX", Name: "@", Value: "mail.example.com"}}); err != nil {
+		t.Fatalf("DeleteRecords() by value failed: %v", err)
+	}
+
+	want := []cfRecord{
+		{ID: "a1", Type: "A", Name: "home.example.com", Content: "192.0.2.2", TTL: 300, Proxied: true},
+		{ID: "txt1", Type: "TXT", Name: "home.example.com", Content: "new", TTL: 300},
+		{ID: "new1", Type: "AAAA", Name: "example.com", Content: "2001:db8::1", TTL: 300},
+	}
+	if !slices.EqualFunc(f.records, want, func(a, b cfRecord) bool { return fmt.Sprint(a) == fmt.Sprint(b) }) {
+		t.Errorf("records are %+v, want %+v", f.records, want)
+	}
+	if f.zoneLookups != 1 {
+		t.Errorf("looked up the zone by name %d times, want 1", f.zoneLookups)
+	}
+}
+
+func TestZoneNameSkipsLookupByName(t *testing.T) {
+	ctx := context.Background()
+	f, c := newFakeCloudflare(t, nil)
+
+	name, err := c.ZoneName(ctx, "zone1")
+	if err != nil {
+		t.Fatalf("ZoneName() failed: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("ZoneName() = %q, want example.com", name)
+	}
+	if _, err := c.AppendRecords(ctx, name, []libdns.Record{{Type: "A", Name: "home", Value: "192.0.2.1", TTL: AutoTTL}}); err != nil {
+		t.Fatalf("AppendRecords() failed: %v", err)
+	}
+	if _, err := c.GetRecords(ctx, name); err != nil {
+		t.Fatalf("GetRecords() failed: %v", err)
+	}
+	if f.zoneLookups != 0 {
+		t.Errorf("looked up the zone by name %d times, want 0", f.zoneLookups)
+	}
+}
+
+func TestLimiterCountsEveryRequest(t *testing.T) {
+	f, c := newFakeCloudflare(t, nil)
+	// The zone lookup and two of the three creates fit in the burst, and
+	// the next token is an hour away.
+	c.Limiter = rate.NewLimiter(rate.Every(time.Hour), 3)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var records []libdns.Record
+	for _, v := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		records = append(records, libdns.Record{Type: "A", Name: "home", Value: v, TTL: AutoTTL})
+	}
+	if _, err := c.AppendRecords(ctx, "example.com", records); err == nil {
+		t.Error("AppendRecords() succeeded, want it to be rate limited")
+	}
+	if len(f.records) != 2 {
+		t.Errorf("created %d records, want 2 within the rate limit", len(f.records))
+	}
+}
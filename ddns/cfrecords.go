@@ -0,0 +1,233 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// This file implements the libdns record interfaces of CloudflareClient with
+// the Cloudflare API, instead of using the libdns cloudflare module. That
+// module's provider can't do what dyncf needs of it:
+//
+//   - GetRecords only reads the first page of 100 records, so records of
+//     larger zones look missing and are created again.
+//   - It sends its requests with http.DefaultClient, so -rate-limit can't be
+//     applied to each of them and the Retry-After of a 429 is lost.
+//   - It always looks zones up by name, so -zone-id can't skip the lookup
+//     or avoid its ambiguity.
+//   - It can't write SRV records at the zone apex.
+//
+// The records are read and written with the zone ID, the limiter and the
+// error handling that CloudflareClient uses for its other requests.
+
+// cfRecord is a DNS record as the API represents it.
+type cfRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content,omitempty"`
+	// TTL is in seconds, where 1 is "Auto".
+	TTL     int  `json:"ttl"`
+	Proxied bool `json:"proxied,omitempty"`
+	// Priority is that of MX records. SRV records keep theirs in Data.
+	Priority *uint      `json:"priority,omitempty"`
+	Data     *cfSRVData `json:"data,omitempty"`
+}
+
+// cfSRVData are the fields of an SRV record.
+type cfSRVData struct {
+	Priority uint   `json:"priority"`
+	Weight   uint   `json:"weight"`
+	Port     uint   `json:"port"`
+	Target   string `json:"target"`
+}
+
+// libdnsRecord returns r, which is in zone, as a libdns record with a name
+// relative to zone.
+func (r cfRecord) libdnsRecord(zone string) libdns.Record {
+	rec := libdns.Record{
+		ID:    r.ID,
+		Type:  r.Type,
+		Name:  libdns.RelativeName(r.Name, zone),
+		Value: r.Content,
+		TTL:   time.Duration(r.TTL) * time.Second,
+	}
+	if r.Priority != nil {
+		rec.Priority = *r.Priority
+	}
+	if r.Type == "SRV" && r.Data != nil {
+		rec.Value = fmt.Sprintf("%d %v", r.Data.Port, r.Data.Target)
+		rec.Priority, rec.Weight = r.Data.Priority, r.Data.Weight
+	}
+	return rec
+}
+
+// listRecords returns all the records in zone. The API returns them a page
+// at a time, so reading only the first page would miss records in larger
+// zones.
+func (c *CloudflareClient) listRecords(ctx context.Context, zone string) ([]cfRecord, error) {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	const perPage = 100
+	var all []cfRecord
+	for page := 1; ; page++ {
+		var records []cfRecord
+		qs := url.Values{"page": {fmt.Sprint(page)}, "per_page": {fmt.Sprint(perPage)}}
+		if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", zoneID, qs.Encode()), nil, &records); err != nil {
+			return nil, err
+		}
+		all = append(all, records...)
+		if len(records) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// GetRecords returns all the records in zone.
+func (c *CloudflareClient) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	records, err := c.listRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]libdns.Record, len(records))
+	for i, r := range records {
+		recs[i] = r.libdnsRecord(zone)
+	}
+	return recs, nil
+}
+
+// cloudflareRecord returns rec, which is in zone, as the API represents it.
+func cloudflareRecord(rec libdns.Record, zone string) (cfRecord, error) {
+	r := cfRecord{
+		Type:    rec.Type,
+		Name:    libdns.AbsoluteName(rec.Name, zone),
+		Content: rec.Value,
+		TTL:     max(1, int(rec.TTL.Seconds())),
+	}
+	switch rec.Type {
+	case "SRV":
+		var port uint
+		var target string
+		if _, err := fmt.Sscan(rec.Value, &port, &target); err != nil {
+			return cfRecord{}, fmt.Errorf("invalid SRV value %q, want port and target: %w", rec.Value, err)
+		}
+		r.Content = ""
+		r.Data = &cfSRVData{Priority: rec.Priority, Weight: rec.Weight, Port: port, Target: target}
+	case "MX":
+		r.Priority = &rec.Priority
+	}
+	return r, nil
+}
+
+// AppendRecords creates records in zone, and returns them as created.
+func (c *CloudflareClient) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var created []libdns.Record
+	for _, rec := range records {
+		r, err := cloudflareRecord(rec, zone)
+		if err != nil {
+			return created, err
+		}
+		var result cfRecord
+		if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zoneID), r, &result); err != nil {
+			return created, err
+		}
+		created = append(created, result.libdnsRecord(zone))
+	}
+	return created, nil
+}
+
+// SetRecords updates records in zone in place, and returns them as updated.
+// A record without an ID replaces the only record with its name and type,
+// or is created if there is none.
+func (c *CloudflareClient) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var updated []libdns.Record
+	for _, rec := range records {
+		r, err := cloudflareRecord(rec, zone)
+		if err != nil {
+			return updated, err
+		}
+		id := rec.ID
+		if id == "" {
+			matches, err := c.findRecords(ctx, zoneID, url.Values{"name": {r.Name}, "type": {r.Type}})
+			if err != nil {
+				return updated, err
+			}
+			if len(matches) > 1 {
+				return updated, fmt.Errorf("found %d %v records for %v, expected at most 1", len(matches), r.Type, r.Name)
+			}
+			if len(matches) == 1 {
+				id = matches[0].ID
+			}
+		}
+		method, path := http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zoneID)
+		if id != "" {
+			// PATCH keeps the fields that aren't sent, like the proxying
+			// and the comment.
+			method, path = http.MethodPatch, path+"/"+url.PathEscape(id)
+		}
+		var result cfRecord
+		if err := c.do(ctx, method, path, r, &result); err != nil {
+			return updated, err
+		}
+		updated = append(updated, result.libdnsRecord(zone))
+	}
+	return updated, nil
+}
+
+// DeleteRecords deletes records from zone, and returns those deleted. A
+// record without an ID deletes the records with its name, type and value.
+func (c *CloudflareClient) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []libdns.Record
+	for _, rec := range records {
+		ids := []string{rec.ID}
+		if rec.ID == "" {
+			r, err := cloudflareRecord(rec, zone)
+			if err != nil {
+				return deleted, err
+			}
+			matches, err := c.findRecords(ctx, zoneID, url.Values{"name": {r.Name}, "type": {r.Type}, "content": {rec.Value}})
+			if err != nil {
+				return deleted, err
+			}
+			ids = nil
+			for _, m := range matches {
+				ids = append(ids, m.ID)
+			}
+		}
+		for _, id := range ids {
+			if err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/zones/%s/dns_records/%s", zoneID, url.PathEscape(id)), nil, nil); err != nil {
+				return deleted, err
+			}
+			rec.ID = id
+			deleted = append(deleted, rec)
+		}
+	}
+	return deleted, nil
+}
+
+// findRecords returns the records of the zone with ID zoneID that match the
+// filters of qs, like name and type.
+func (c *CloudflareClient) findRecords(ctx context.Context, zoneID string, qs url.Values) ([]cfRecord, error) {
+	var records []cfRecord
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", zoneID, qs.Encode()), nil, &records)
+	return records, err
+}
@@ -0,0 +1,52 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CommandSource runs a shell command to detect the address, for setups that
+// find it in their own way, e.g. by asking a UPnP gateway. The command gets
+// the record type in DYNCF_TYPE and prints a bare address to stdout. Its
+// stderr goes to ours, along with the logs.
+type CommandSource struct {
+	Command string
+	// Timeout, if non-zero, bounds each run of the command.
+	Timeout time.Duration
+}
+
+func (s CommandSource) String() string { return "command:" + s.Command }
+
+func (s CommandSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.Command)
+	cmd.Env = append(os.Environ(), "DYNCF_TYPE="+recordType)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	// Killing the shell leaves its children holding stdout open, so don't
+	// wait long for them.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("command %q: %w", s.Command, wrapTimeout(ctx.Err()))
+		}
+		return nil, fmt.Errorf("command %q failed: %w", s.Command, err)
+	}
+	out := strings.TrimSpace(stdout.String())
+	addr := net.ParseIP(out)
+	if addr == nil {
+		return nil, fmt.Errorf("could not parse address %q from command %q", out, s.Command)
+	}
+	return addr, checkFamily(addr, recordType)
+}
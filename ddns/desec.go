@@ -0,0 +1,370 @@
+package ddns
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"golang.org/x/time/rate"
+)
+
+const desecBaseURL = "https://desec.io/api/v1"
+
+var _ Provider = (*DesecClient)(nil)
+
+// DesecClient is a Provider for deSEC. deSEC keeps the records of a name and
+// type together in an RRset and has no record IDs, so the ID of a record is
+// its name, type and value, which lets SetRecords replace that value within
+// its RRset. All the records of an RRset share its TTL.
+type DesecClient struct {
+	Token string
+	// Limiter is waited on before every request, if set.
+	Limiter *rate.Limiter
+
+	// baseURL replaces desecBaseURL, if set, e.g. for tests.
+	baseURL string
+}
+
+// desecRRset is an RRset as the API represents it.
+type desecRRset struct {
+	// Subname is the name relative to the zone, which is empty at the apex.
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+// desecKey identifies an RRset within a zone.
+type desecKey struct{ subname, recordType string }
+
+// desecID returns the ID of the record of rs with the API value content.
+func desecID(rs desecRRset, content string) string {
+	return rs.Subname + "/" + rs.Type + "/" + content
+}
+
+// parseDesecID splits an ID from desecID into the RRset and the API value
+// of its record.
+func parseDesecID(id string) (desecKey, string, error) {
+	parts := strings.SplitN(id, "/", 3)
+	if len(parts) != 3 {
+		return desecKey{}, "", fmt.Errorf("invalid deSEC record ID %q", id)
+	}
+	return desecKey{parts[0], parts[1]}, parts[2], nil
+}
+
+// desecSubname returns name, which is relative to zone, as the API names it.
+func desecSubname(name, zone string) string {
+	return libdns.RelativeName(libdns.AbsoluteName(name, zone), zone)
+}
+
+// desecContent returns the value of rec as the API represents it: TXT values
+// are quoted, priorities and weights are part of the value, and names are
+// fully qualified.
+func desecContent(rec libdns.Record) (string, error) {
+	switch rec.Type {
+	case "TXT":
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(rec.Value) + `"`, nil
+	case "CNAME", "NS", "PTR":
+		return strings.TrimSuffix(rec.Value, ".") + ".", nil
+	case "MX":
+		return fmt.Sprintf("%d %s.", rec.Priority, strings.TrimSuffix(rec.Value, ".")), nil
+	case "SRV":
+		var port uint
+		var target string
+		if _, err := fmt.Sscan(rec.Value, &port, &target); err != nil {
+			return "", fmt.Errorf("invalid SRV value %q, want port and target: %w", rec.Value, err)
+		}
+		return fmt.Sprintf("%d %d %d %s.", rec.Priority, rec.Weight, port, strings.TrimSuffix(target, ".")), nil
+	}
+	return rec.Value, nil
+}
+
+// libdnsRecord returns the record of rs with the API value content as a
+// libdns record, undoing desecContent.
+func (rs desecRRset) libdnsRecord(content string) libdns.Record {
+	rec := libdns.Record{
+		ID:    desecID(rs, content),
+		Type:  rs.Type,
+		Name:  rs.Subname,
+		Value: content,
+		TTL:   time.Duration(rs.TTL) * time.Second,
+	}
+	switch rs.Type {
+	case "TXT":
+		if v, ok := strings.CutPrefix(content, `"`); ok && strings.HasSuffix(v, `"`) {
+			rec.Value = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(strings.TrimSuffix(v, `"`))
+		}
+	case "CNAME", "NS", "PTR":
+		rec.Value = strings.TrimSuffix(content, ".")
+	case "MX":
+		var target string
+		if _, err := fmt.Sscan(content, &rec.Priority, &target); err == nil {
+			rec.Value = strings.TrimSuffix(target, ".")
+		}
+	case "SRV":
+		var port uint
+		var target string
+		if _, err := fmt.Sscan(content, &rec.Priority, &rec.Weight, &port, &target); err == nil {
+			rec.Value = fmt.Sprintf("%d %s", port, strings.TrimSuffix(target, "."))
+		}
+	}
+	return rec
+}
+
+// GetRecords returns all the records in zone. The API returns the RRsets a
+// page at a time once there are more than 500 of them, so every page is
+// read.
+func (c *DesecClient) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	var recs []libdns.Record
+	// An empty cursor asks for the first page, and the next one is linked
+	// from each page.
+	next := c.url(fmt.Sprintf("/domains/%s/rrsets/?cursor=", url.PathEscape(zone)))
+	for next != "" {
+		var rrsets []desecRRset
+		header, err := c.do(ctx, http.MethodGet, next, nil, &rrsets)
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range rrsets {
+			for _, content := range rs.Records {
+				recs = append(recs, rs.libdnsRecord(content))
+			}
+		}
+		next = nextLink(header.Get("Link"))
+	}
+	return recs, nil
+}
+
+// nextLink returns the URL of the link with rel="next" in a Link header, or
+// "" if there is none.
+func nextLink(h string) string {
+	for _, link := range strings.Split(h, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if ok && strings.Contains(params, `rel="next"`) {
+			return strings.Trim(strings.TrimSpace(target), "<>")
+		}
+	}
+	return ""
+}
+
+// AppendRecords adds records to their RRsets in zone, and returns them as
+// created.
+func (c *DesecClient) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	e := &desecEdit{c: c, zone: zone}
+	var created []libdns.Record
+	for _, rec := range records {
+		rs, content, err := e.rrset(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		rs.setTTL(rec.TTL)
+		rs.add(content)
+		created = append(created, rs.libdnsRecord(content))
+	}
+	if err := e.save(ctx); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// SetRecords updates records in zone in place, and returns them as updated.
+// A record with an ID replaces the value the ID names, which must be of the
+// same name and type. The records without an ID of a name and type replace
+// all the values of their RRset together.
+func (c *DesecClient) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	e := &desecEdit{c: c, zone: zone}
+	var updated []libdns.Record
+	replaced := make(map[*desecRRset]bool)
+	for _, rec := range records {
+		rs, content, err := e.rrset(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		rs.setTTL(rec.TTL)
+		if rec.ID != "" {
+			key, old, err := parseDesecID(rec.ID)
+			if err != nil {
+				return nil, err
+			}
+			if key != (desecKey{rs.Subname, rs.Type}) {
+				return nil, fmt.Errorf("record ID %q is not of a %v record named %q", rec.ID, rs.Type, rs.Subname)
+			}
+			rs.remove(old)
+		} else if !replaced[rs] {
+			rs.Records = nil
+			replaced[rs] = true
+		}
+		rs.add(content)
+		updated = append(updated, rs.libdnsRecord(content))
+	}
+	if err := e.save(ctx); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteRecords removes records from their RRsets in zone, and returns those
+// deleted. A record without an ID deletes the record with its name, type and
+// value.
+func (c *DesecClient) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	e := &desecEdit{c: c, zone: zone}
+	var deleted []libdns.Record
+	for _, rec := range records {
+		rs, content, err := e.rrset(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		if rec.ID != "" {
+			if _, content, err = parseDesecID(rec.ID); err != nil {
+				return nil, err
+			}
+		}
+		if rs.remove(content) {
+			deleted = append(deleted, rs.libdnsRecord(content))
+		}
+	}
+	if err := e.save(ctx); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// desecEdit collects the changes to the RRsets of a zone, so that they're
+// written together.
+type desecEdit struct {
+	c    *DesecClient
+	zone string
+	// rrsets are the RRsets read so far, in the order they were read.
+	rrsets []*desecRRset
+}
+
+// rrset returns the RRset of rec, reading it the first time, and the API
+// value of rec.
+func (e *desecEdit) rrset(ctx context.Context, rec libdns.Record) (*desecRRset, string, error) {
+	content, err := desecContent(rec)
+	if err != nil {
+		return nil, "", err
+	}
+	key := desecKey{desecSubname(rec.Name, e.zone), rec.Type}
+	var rs *desecRRset
+	if i := slices.IndexFunc(e.rrsets, func(r *desecRRset) bool { return r.Subname == key.subname && r.Type == key.recordType }); i >= 0 {
+		rs = e.rrsets[i]
+	} else {
+		rs = &desecRRset{Subname: key.subname, Type: key.recordType}
+		// The API names the apex "@" in paths.
+		path := fmt.Sprintf("/domains/%s/rrsets/%s/%s/", url.PathEscape(e.zone), url.PathEscape(cmp.Or(key.subname, "@")), url.PathEscape(key.recordType))
+		if _, err := e.c.do(ctx, http.MethodGet, e.c.url(path), nil, rs); err != nil {
+			var httpErr *httpError
+			if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+				return nil, "", err
+			}
+		}
+		e.rrsets = append(e.rrsets, rs)
+	}
+	return rs, content, nil
+}
+
+// setTTL sets the TTL of rs to ttl, unless it's unset. It applies to all
+// the records of rs.
+func (rs *desecRRset) setTTL(ttl time.Duration) {
+	if ttl > 0 {
+		rs.TTL = int(ttl.Seconds())
+	}
+}
+
+// add adds content to the records of rs, unless it's there already.
+func (rs *desecRRset) add(content string) {
+	if !slices.Contains(rs.Records, content) {
+		rs.Records = append(rs.Records, content)
+	}
+}
+
+// remove removes content from the records of rs, and reports whether it was
+// there.
+func (rs *desecRRset) remove(content string) bool {
+	had := slices.Contains(rs.Records, content)
+	rs.Records = slices.DeleteFunc(rs.Records, func(r string) bool { return r == content })
+	return had
+}
+
+// save writes the RRsets of e in one request, which the API applies
+// atomically. An RRset left without records is deleted.
+func (e *desecEdit) save(ctx context.Context) error {
+	if len(e.rrsets) == 0 {
+		return nil
+	}
+	rrsets := make([]desecRRset, len(e.rrsets))
+	for i, rs := range e.rrsets {
+		rrsets[i] = *rs
+		if rrsets[i].Records == nil {
+			rrsets[i].Records = []string{}
+		}
+	}
+	_, err := e.c.do(ctx, http.MethodPut, e.c.url(fmt.Sprintf("/domains/%s/rrsets/", url.PathEscape(e.zone))), rrsets, nil)
+	return err
+}
+
+// url returns the URL of the API path.
+func (c *DesecClient) url(path string) string {
+	return cmp.Or(c.baseURL, desecBaseURL) + path
+}
+
+// do makes an API request to u, encoding body as the request and decoding
+// the response into result if it's non-nil, and returns the response
+// headers.
+func (c *DesecClient) do(ctx context.Context, method, u string, body, result any) (http.Header, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// The request headers hold the token, so only the URL is logged.
+	Logger(ctx).Debug("got api response", "method", method, "url", req.URL.String(), "status", resp.Status)
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := &httpError{StatusCode: resp.StatusCode, msg: string(bytes.TrimSpace(msg))}
+		if wait := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); resp.StatusCode == http.StatusTooManyRequests && wait > 0 {
+			return nil, &rateLimitError{retryAfter: wait, err: err}
+		}
+		return nil, err
+	}
+	if result != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,223 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// fakeDesec serves the parts of the deSEC API that DesecClient uses for the
+// zone example.com. It pages the RRsets like the API does, but pageSize at a
+// time instead of 500.
+type fakeDesec struct {
+	t        *testing.T
+	url      string
+	pageSize int
+
+	mu     sync.Mutex
+	rrsets []desecRRset
+}
+
+// newFakeDesec starts a fakeDesec holding rrsets, and returns a client of it.
+func newFakeDesec(t *testing.T, rrsets []desecRRset) (*fakeDesec, *DesecClient) {
+	t.Helper()
+	f := &fakeDesec{t: t, pageSize: 2, rrsets: rrsets}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /domains/example.com/rrsets/", f.list)
+	mux.HandleFunc("GET /domains/example.com/rrsets/{subname}/{type}/", f.get)
+	mux.HandleFunc("PUT /domains/example.com/rrsets/", f.put)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token token" {
+			http.Error(w, `{"detail":"Invalid token."}`, http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	return f, &DesecClient{Token: "token", baseURL: srv.URL}
+}
+
+func (f *fakeDesec) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !r.URL.Query().Has("cursor") && len(f.rrsets) > f.pageSize {
+		http.Error(w, `{"detail":"Pagination required."}`, http.StatusBadRequest)
+		return
+	}
+	start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+	end := min(len(f.rrsets), start+f.pageSize)
+	if end < len(f.rrsets) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/domains/example.com/rrsets/?cursor=>; rel="first", <%s/domains/example.com/rrsets/?cursor=%d>; rel="next"`, f.url, f.url, end))
+	}
+	f.write(w, f.rrsets[start:end])
+}
+
+func (f *fakeDesec) get(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subname := r.PathValue("subname")
+	if subname == "@" {
+		subname = ""
+	}
+	i := slices.IndexFunc(f.rrsets, func(rs desecRRset) bool { return rs.Subname == subname && rs.Type == r.PathValue("type") })
+	if i < 0 {
+		http.Error(w, `{"detail":"Not found."}`, http.StatusNotFound)
+		return
+	}
+	f.write(w, f.rrsets[i])
+}
+
+func (f *fakeDesec) put(w http.ResponseWriter, r *http.Request) {
+	var rrsets []desecRRset
+	if err := json.NewDecoder(r.Body).Decode(&rrsets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rs := range rrsets {
+		if rs.TTL < 3600 {
+			http.Error(w, `[{"ttl":["Ensure this value is greater than or equal to 3600."]}]`, http.StatusBadRequest)
+			return
+		}
+		f.rrsets = slices.DeleteFunc(f.rrsets, func(old desecRRset) bool { return old.Subname == rs.Subname && old.Type == rs.Type })
+		if len(rs.Records) > 0 {
+			f.rrsets = append(f.rrsets, rs)
+		}
+	}
+	f.write(w, rrsets)
+}
+
+// write writes v as the JSON body of a response.
+func (f *fakeDesec) write(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Errorf("could not write response: %v", err)
+	}
+}
+
+// rrset returns the RRset of the fake with subname and recordType.
+func (f *fakeDesec) rrset(subname, recordType string) (desecRRset, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := slices.IndexFunc(f.rrsets, func(rs desecRRset) bool { return rs.Subname == subname && rs.Type == recordType })
+	if i < 0 {
+		return desecRRset{}, false
+	}
+	return f.rrsets[i], true
+}
+
+func TestDesecGetRecords(t *testing.T) {
+	_, c := newFakeDesec(t, []desecRRset{
+		{Subname: "home", Type: "A", TTL: 3600, Records: []string{"192.0.2.1", "192.0.2.2"}},
+		{Subname: "home", Type: "TXT", TTL: 3600, Records: []string{`"say \"hi\""`}},
+		{Subname: "", Type: "MX", TTL: 3600, Records: []string{"10 mail.example.com."}},
+		{Subname: "www", Type: "CNAME", TTL: 3600, Records: []string{"home.example.com."}},
+		{Subname: "_minecraft._tcp", Type: "SRV", TTL: 3600, Records: []string{"1 2 25565 example.com."}},
+	})
+
+	got, err := c.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("GetRecords() failed: %v", err)
+	}
+	want := []libdns.Record{
+		{ID: "home/A/192.0.2.1", Type: "A", Name: "home", Value: "192.0.2.1", TTL: time.Hour},
+		{ID: "home/A/192.0.2.2", Type: "A", Name: "home", Value: "192.0.2.2", TTL: time.Hour},
+		{ID: `home/TXT/"say \"hi\""`, Type: "TXT", Name: "home", Value: `say "hi"`, TTL: time.Hour},
+		{ID: "/MX/10 mail.example.com.", Type: "MX", Name: "", Value: "mail.example.com", TTL: time.Hour, Priority: 10},
+		{ID: "www/CNAME/home.example.com.", Type: "CNAME", Name: "www", Value: "home.example.com", TTL: time.Hour},
+		{ID: "_minecraft._tcp/SRV/1 2 25565 example.com.", Type: "SRV", Name: "_minecraft._tcp", Value: "25565 example.com", TTL: time.Hour, Priority: 1, Weight: 2},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("GetRecords() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDesecWrites(t *testing.T) {
+	ctx := context.Background()
+	f, c := newFakeDesec(t, []desecRRset{
+		{Subname: "home", Type: "A", TTL: 3600, Records: []string{"192.0.2.1", "192.0.2.2"}},
+		{Subname: "home", Type: "TXT", TTL: 3600, Records: []string{`"old"`}},
+		{Subname: "", Type: "MX", TTL: 3600, Records: []string{"10 mail.example.com."}},
+	})
+
+	if _, err := c.SetRecords(ctx, "example.com", []libdns.Record{{ID: "home/A/192.0.2.2", Type: "A", Name: "home", Value: "192.0.2.3", TTL: 2 * time.Hour}}); err != nil {
+		t.Fatalf("SetRecords() by ID failed: %v", err)
+	}
+	if _, err := c.SetRecords(ctx, "example.com", []libdns.Record{{Type: "TXT", Name: "home", Value: "new", TTL: time.Hour}}); err != nil {
+		t.Fatalf("SetRecords() by name failed: %v", err)
+	}
+	created, err := c.AppendRecords(ctx, "example.com", []libdns.Record{{Type: "AAAA", Name: "@", Value: "2001:db8::1", TTL: time.Hour}})
+	if err != nil {
+		t.Fatalf("AppendRecords() failed: %v", err)
+	}
+	if want := "/AAAA/2001:db8::1"; len(created) != 1 || created[0].ID != want {
+		t.Errorf("AppendRecords() = %+v, want one record with ID %q", created, want)
+	}
+	if _, err := c.DeleteRecords(ctx, "example.com", []libdns.Record{{Type: "MX", Name: "@", Value: "mail.example.com", Priority: 10}}); err != nil {
+		t.Fatalf("DeleteRecords() by value failed: %v", err)
+	}
+
+	for _, want := range []desecRRset{
+		{Subname: "home", Type: "A", TTL: 7200, Records: []string{"192.0.2.1", "192.0.2.3"}},
+		{Subname: "home", Type: "TXT", TTL: 3600, Records: []string{`"new"`}},
+		{Subname: "", Type: "AAAA", TTL: 3600, Records: []string{"2001:db8::1"}},
+	} {
+		if got, ok := f.rrset(want.Subname, want.Type); !ok || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s %s RRset is %+v, want %+v", want.Subname, want.Type, got, want)
+		}
+	}
+	if got, ok := f.rrset("", "MX"); ok {
+		t.Errorf("MX RRset is %+v, want it deleted", got)
+	}
+}
+
+func TestDesecUpdate(t *testing.T) {
+	f, c := newFakeDesec(t, []desecRRset{
+		{Subname: "", Type: "A", TTL: 3600, Records: []string{"192.0.2.9"}},
+		{Subname: "www", Type: "A", TTL: 3600, Records: []string{"198.51.100.1"}},
+	})
+	var statuses []string
+	u := &Updater{
+		Provider:     c,
+		Source:       StaticSource{"A": {net.IPv4(192, 0, 2, 1)}},
+		Domains:      []Domain{{Zone: "example.com", Subdomain: "@", TTL: time.Hour, RecordTypes: []string{"A", "SRV"}}},
+		RecordTypes:  []string{"A", "SRV"},
+		SRV:          &SRV{Service: "minecraft", Proto: "tcp", Port: 25565, Priority: 1, Weight: 2},
+		AllowPrivate: true,
+		OnResult:     func(_ context.Context, r Result) { statuses = append(statuses, r.Type+" "+r.Status) },
+	}
+
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	// The SRV record at the apex has the service and proto as its name.
+	if got, ok := f.rrset("_minecraft._tcp", "SRV"); !ok || !slices.Equal(got.Records, []string{"1 2 25565 example.com."}) {
+		t.Errorf("SRV RRset is %+v, want 1 2 25565 example.com.", got)
+	}
+	if got, _ := f.rrset("", "A"); !slices.Equal(got.Records, []string{"192.0.2.1"}) {
+		t.Errorf("A RRset is %+v, want 192.0.2.1", got)
+	}
+	if got, _ := f.rrset("www", "A"); !slices.Equal(got.Records, []string{"198.51.100.1"}) {
+		t.Errorf("www A RRset is %+v, want it unchanged", got)
+	}
+
+	statuses = nil
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("second Update() failed: %v", err)
+	}
+	if want := []string{"A unchanged", "SRV unchanged"}; !slices.Equal(statuses, want) {
+		t.Errorf("second Update() results = %v, want %v", statuses, want)
+	}
+}
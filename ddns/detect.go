@@ -0,0 +1,473 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IPSource discovers the public address of this host.
+type IPSource interface {
+	// DetectIP returns the address used for records of recordType, which
+	// is either "A" or "AAAA".
+	DetectIP(ctx context.Context, recordType string) (net.IP, error)
+}
+
+// maxTraceBody is the most of a trace response that is read. Real responses
+// are a few hundred bytes.
+const maxTraceBody = 4 << 10
+
+// traceSource reads the "ip=" line of a Cloudflare style trace endpoint.
+type traceSource struct {
+	url string
+	f   *Fetcher
+}
+
+func (s traceSource) String() string { return s.url }
+
+func (s traceSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	body, err := s.f.get(ctx, recordType, s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	// Read one byte more than the limit to tell whether there was more.
+	b, err := io.ReadAll(io.LimitReader(body, maxTraceBody+1))
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+	truncated := len(b) > maxTraceBody
+	if truncated {
+		// Drop the last line, which was cut off and could hold a
+		// shortened but valid address.
+		b = b[:bytes.LastIndexByte(b[:maxTraceBody], '\n')+1]
+	}
+	Logger(ctx).Debug("read trace", "url", s.url, "type", recordType, "body", string(b))
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "ip="); ok {
+			addr := net.ParseIP(strings.TrimSpace(v))
+			if addr == nil {
+				return nil, fmt.Errorf("failed to parse detected IP %q", v)
+			}
+			return addr, checkFamily(addr, recordType)
+		}
+	}
+	if truncated {
+		return nil, fmt.Errorf("no address found in the first %d bytes of the response", maxTraceBody)
+	}
+	return nil, fmt.Errorf("no address found")
+}
+
+// plainSource reads a bare address from the response body, as returned by
+// services like ipify.
+type plainSource struct {
+	url string
+	f   *Fetcher
+}
+
+func (s plainSource) String() string { return s.url }
+
+func (s plainSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	body, err := s.f.get(ctx, recordType, s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(io.LimitReader(body, 256))
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+	addr := net.ParseIP(strings.TrimSpace(string(b)))
+	if addr == nil {
+		return nil, fmt.Errorf("could not parse address %q", b)
+	}
+	return addr, checkFamily(addr, recordType)
+}
+
+// checkFamily returns an error if addr can't be published in records of
+// recordType, which can happen if the request fell back to the other family.
+func checkFamily(addr net.IP, recordType string) error {
+	if recordTypeOf(addr) != recordType {
+		return fmt.Errorf("detected %v, which is not an address for %v records", addr, recordType)
+	}
+	return nil
+}
+
+// MultiIPSource is an IPSource that can return several addresses of the same
+// family, all of which should be published.
+type MultiIPSource interface {
+	IPSource
+	// DetectIPs returns all the addresses of records of recordType.
+	DetectIPs(ctx context.Context, recordType string) ([]net.IP, error)
+}
+
+// DetectIPs returns the addresses from source for records of recordType.
+func DetectIPs(ctx context.Context, source IPSource, recordType string) ([]net.IP, error) {
+	if s, ok := source.(MultiIPSource); ok {
+		return s.DetectIPs(ctx, recordType)
+	}
+	addr, err := source.DetectIP(ctx, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{addr}, nil
+}
+
+// StaticSource returns addresses that were given up front instead of
+// detecting them.
+type StaticSource map[string][]net.IP
+
+func (s StaticSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	addrs, err := s.DetectIPs(ctx, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+func (s StaticSource) DetectIPs(_ context.Context, recordType string) ([]net.IP, error) {
+	addrs, ok := s[recordType]
+	if !ok {
+		return nil, fmt.Errorf("no %v address given", recordType)
+	}
+	return addrs, nil
+}
+
+// ParseStaticSource parses a comma-separated list of addresses. Giving
+// several addresses of the same family publishes all of them.
+func ParseStaticSource(list string) (StaticSource, error) {
+	s := make(StaticSource)
+	for _, str := range strings.Split(list, ",") {
+		addr := net.ParseIP(strings.TrimSpace(str))
+		if addr == nil {
+			return nil, fmt.Errorf("invalid address %q", str)
+		}
+		recordType := recordTypeOf(addr)
+		if slices.ContainsFunc(s[recordType], addr.Equal) {
+			return nil, fmt.Errorf("address %v given more than once", addr)
+		}
+		s[recordType] = append(s[recordType], addr)
+	}
+	return s, nil
+}
+
+// PrefixSource publishes the address of another host on the same network,
+// by combining the /64 prefix of the AAAA addresses from Source with the
+// interface identifier in Suffix. A addresses are passed through unchanged.
+type PrefixSource struct {
+	Source IPSource
+	Suffix net.IP
+}
+
+func (s PrefixSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	addrs, err := s.DetectIPs(ctx, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+func (s PrefixSource) DetectIPs(ctx context.Context, recordType string) ([]net.IP, error) {
+	addrs, err := DetectIPs(ctx, s.Source, recordType)
+	if err != nil || recordType != "AAAA" {
+		return addrs, err
+	}
+	var combined []net.IP
+	for _, addr := range addrs {
+		ip, err := withSuffix(addr, s.Suffix)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(combined, ip.Equal) {
+			combined = append(combined, ip)
+		}
+	}
+	return combined, nil
+}
+
+// ParseV6Suffix parses an interface identifier written as an IPv6 address,
+// such as "::1234". Only its low 64 bits may be set.
+func ParseV6Suffix(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 suffix %q", s)
+	}
+	if !net.IP(ip[:8]).Equal(net.IPv6zero[:8]) {
+		return nil, fmt.Errorf("IPv6 suffix %v is longer than 64 bits", ip)
+	}
+	return ip, nil
+}
+
+// withSuffix returns the address made of the /64 prefix of prefix and the low
+// 64 bits of suffix.
+func withSuffix(prefix, suffix net.IP) (net.IP, error) {
+	if prefix.To4() != nil {
+		return nil, fmt.Errorf("%v is not an IPv6 address", prefix)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip[:8], prefix.To16()[:8])
+	copy(ip[8:], suffix.To16()[8:])
+	if !ip.IsGlobalUnicast() {
+		return nil, fmt.Errorf("prefix of %v with suffix %v is %v, which is not a global unicast address", prefix, suffix, ip)
+	}
+	return ip, nil
+}
+
+// cgnat is the shared address space used for carrier-grade NAT.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// CheckPublic returns an error if addr can't be reached from the internet,
+// such as a private, loopback, link-local or CGNAT address.
+func CheckPublic(addr net.IP) error {
+	switch {
+	case addr.IsPrivate():
+		return fmt.Errorf("%v is a private address", addr)
+	case addr.IsLoopback():
+		return fmt.Errorf("%v is a loopback address", addr)
+	case addr.IsLinkLocalUnicast():
+		return fmt.Errorf("%v is a link-local address", addr)
+	case cgnat.Contains(addr):
+		return fmt.Errorf("%v is a CGNAT address", addr)
+	case !addr.IsGlobalUnicast():
+		return fmt.Errorf("%v is not a global unicast address", addr)
+	}
+	return nil
+}
+
+// checkAllowed returns an error if addr isn't in any of nets. Any address is
+// allowed if nets is empty.
+func checkAllowed(addr net.IP, nets []*net.IPNet) error {
+	if len(nets) == 0 || slices.ContainsFunc(nets, func(n *net.IPNet) bool { return n.Contains(addr) }) {
+		return nil
+	}
+	return fmt.Errorf("%v is not in any allowed range", addr)
+}
+
+// recordTypeOf returns the type of record that holds addr.
+func recordTypeOf(addr net.IP) string {
+	if addr.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
+
+// sourceChain tries each source in order until one of them succeeds.
+type sourceChain []IPSource
+
+func (c sourceChain) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	var errs []error
+	for _, s := range c {
+		addr, err := s.DetectIP(ctx, recordType)
+		if err == nil {
+			return addr, nil
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			Logger(ctx).Debug("ip source skipped", "source", s, "type", recordType, "err", err)
+		} else {
+			Logger(ctx).Warn("ip source failed", "source", s, "type", recordType, "err", err)
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", s, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// DefaultTraceURL is the trace endpoint used by the "trace" source unless
+// another one is configured.
+const DefaultTraceURL = "https://cloudflare.com/cdn-cgi/trace"
+
+// ParseIPSources parses a list of sources. Each one is either the name of a
+// well-known source or a URL that returns a bare address. The "trace" source
+// reads traceURL, and the "stun" source queries stunServer.
+func ParseIPSources(names []string, traceURL, stunServer string, f *Fetcher) (IPSource, error) {
+	var chain sourceChain
+	for _, name := range names {
+		switch {
+		case name == "trace":
+			chain = append(chain, traceSource{url: traceURL, f: f})
+		case name == "ipify":
+			chain = append(chain, plainSource{url: "https://api64.ipify.org", f: f})
+		case name == "stun":
+			chain = append(chain, stunSource{server: stunServer, f: f})
+		case strings.HasPrefix(name, "https://"), strings.HasPrefix(name, "http://"):
+			chain = append(chain, plainSource{url: name, f: f})
+		default:
+			return nil, fmt.Errorf("unknown ip source %q", name)
+		}
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// Fetcher makes the HTTP requests used to detect addresses.
+type Fetcher struct {
+	// Timeout bounds each request, including reading the response body.
+	Timeout time.Duration
+	// Resolver looks up the hosts of the sources. If nil, the system
+	// resolver is used.
+	Resolver *net.Resolver
+	// Local maps record types to the local address that requests for them
+	// are sent from. If an address is missing, the kernel picks one.
+	Local map[string]net.IP
+	// NoProxy makes requests ignore the HTTP_PROXY and HTTPS_PROXY
+	// environment variables.
+	NoProxy bool
+	// UserAgent is sent with every request, if set.
+	UserAgent string
+	// Fallback retries a connection that fails over the family of the
+	// record type over any family. Addresses of the wrong family are still
+	// rejected, but some networks answer with the right one anyway.
+	Fallback bool
+	// Dial opens the connections for requests, which must use the given
+	// network. If nil, a net.Dialer using Resolver and Local is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// get fetches url over a connection of the address family matching
+// recordType, so that the server sees the address we want to publish.
+func (f *Fetcher) get(ctx context.Context, recordType, url string) (io.ReadCloser, error) {
+	var netType string
+	switch recordType {
+	case "A":
+		netType = "tcp4"
+	case "AAAA":
+		netType = "tcp6"
+	default:
+		return nil, fmt.Errorf("unknown record type %v", recordType)
+	}
+	proxy := http.ProxyFromEnvironment
+	if f.NoProxy {
+		proxy = nil
+	}
+	client := &http.Client{
+		Timeout: f.Timeout,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+				conn, err := f.dial(ctx, recordType, netType, addr)
+				if err == nil || !f.Fallback || f.Local[recordType] != nil {
+					return conn, err
+				}
+				Logger(ctx).Warn("could not connect, falling back to any address family", "type", recordType, "err", err)
+				if conn, ferr := f.dial(ctx, recordType, "tcp", addr); ferr == nil {
+					return conn, nil
+				}
+				return nil, err
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+	Logger(ctx).Debug("got detection response", "url", url, "type", recordType, "status", resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// dial connects to addr over network, from the local address for recordType
+// if there is one.
+func (f *Fetcher) dial(ctx context.Context, recordType, network, addr string) (net.Conn, error) {
+	if f.Dial != nil {
+		return f.Dial(ctx, network, addr)
+	}
+	d := &net.Dialer{Resolver: f.Resolver}
+	local := f.Local[recordType]
+	if local == nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	d.LocalAddr = &net.TCPAddr{IP: local}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect from %v: %w", local, err)
+	}
+	return conn, nil
+}
+
+// ParseBindAddr returns the local address of the family of recordType named by
+// s, which is either an address assigned to this machine or the name of an
+// interface, whose first global address of that family is used.
+func ParseBindAddr(s, recordType string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if recordTypeOf(ip) != recordType {
+			return nil, fmt.Errorf("%v is not an address for %v records", s, recordType)
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("could not list local addresses: %w", err)
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not assigned to any interface", s)
+	}
+	if _, err := net.InterfaceByName(s); err != nil {
+		return nil, fmt.Errorf("%v is neither an address nor an interface: %w", s, err)
+	}
+	return InterfaceAddr(s, recordType)
+}
+
+// InterfaceAddr returns the first global address of the family of recordType
+// of the interface named name.
+func InterfaceAddr(name, recordType string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not find interface %v: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not list addresses of %v: %w", name, err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && recordTypeOf(n.IP) == recordType && n.IP.IsGlobalUnicast() {
+			return n.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %v has no global address for %v records", name, recordType)
+}
+
+// NewResolver returns a resolver that sends all queries to the DNS server at
+// addr, which defaults to port 53.
+func NewResolver(addr string) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid resolver address: %w", err)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// wrapTimeout makes it clear that err was caused by a request timing out.
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("detection timed out: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package ddns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveTrace starts a server that answers every request with body, and
+// returns its URL.
+func serveTrace(t *testing.T, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(serveBody(body))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// testFetcher returns a Fetcher that connects to the test servers over IPv4
+// for either record type, since they only listen on 127.0.0.1.
+func testFetcher() *Fetcher {
+	return &Fetcher{
+		NoProxy: true,
+		Dial: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp4", addr)
+		},
+	}
+}
+
+func TestTraceSource(t *testing.T) {
+	for _, tc := range []struct {
+		name, body, recordType string
+		want                   string
+		// wantErr is part of the error, if one is expected.
+		wantErr string
+	}{
+		{
+			name:       "v4",
+			body:       "fl=123f1\nh=cloudflare.com\nip=203.0.113.7\nts=1728900000.123\nvisit_scheme=https\n",
+			recordType: "A",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "v6",
+			body:       "fl=123f1\nh=cloudflare.com\nip=2001:db8::7\nts=1728900000.123\n",
+			recordType: "AAAA",
+			want:       "2001:db8::7",
+		},
+		{
+			name:       "missing ip",
+			body:       "fl=123f1\nh=cloudflare.com\nts=1728900000.123\n",
+			recordType: "A",
+			wantErr:    "no address found",
+		},
+		{
+			name:       "wrong family",
+			body:       "ip=203.0.113.7\n",
+			recordType: "AAAA",
+			wantErr:    "not an address for AAAA records",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := traceSource{url: serveTrace(t, tc.body), f: testFetcher()}
+			addr, err := s.DetectIP(context.Background(), tc.recordType)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("DetectIP() = %v, %v, want an error containing %q", addr, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DetectIP() failed: %v", err)
+			}
+			if !addr.Equal(net.ParseIP(tc.want)) {
+				t.Errorf("DetectIP() = %v, want %v", addr, tc.want)
+			}
+		})
+	}
+}
+
+func TestTraceSourceMalformed(t *testing.T) {
+	// The size limit cuts the ip= line of long to "ip=203.0.113.7", which
+	// is a valid address, but the wrong one.
+	long := strings.Repeat("a", maxTraceBody-len("\nip=203.0.113.7")) + "\nip=203.0.113.77\n"
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{"valid", serveBody("ip=203.0.113.7\n"), false},
+		{"garbage after address", serveBody("ip=1.2.3.4garbage\n"), true},
+		{"empty value", serveBody("ip=\n"), true},
+		{"cut off by the size limit", serveBody(long), true},
+		{"connection closed early", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("fl=123f1\nip=203.0.113.7"))
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+			s := traceSource{url: srv.URL, f: testFetcher()}
+			addr, err := s.DetectIP(context.Background(), "A")
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("DetectIP() = %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil || !addr.Equal(net.IPv4(203, 0, 113, 7)) {
+				t.Errorf("DetectIP() = %v, %v, want 203.0.113.7", addr, err)
+			}
+		})
+	}
+}
+
+// serveBody returns a handler that answers with body.
+func serveBody(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,119 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// Domain is a single name to keep pointed at this host.
+type Domain struct {
+	Zone string
+	// Subdomain is the name relative to Zone, or "@" for the apex.
+	Subdomain string
+
+	TTL         time.Duration
+	Proxied     bool
+	RecordTypes []string
+	// KeepAutoTTL leaves records that use Cloudflare's automatic TTL on it,
+	// instead of setting TTL.
+	KeepAutoTTL bool
+
+	// Provider and Cloudflare, if Provider is set, replace those of the
+	// Updater for this domain, e.g. for a zone in another account. All the
+	// domains of a zone must use the same ones.
+	Provider   Provider
+	Cloudflare *CloudflareClient
+}
+
+// Name returns the fully qualified name of d.
+func (d Domain) Name() string {
+	return libdns.AbsoluteName(d.Subdomain, d.Zone)
+}
+
+// ParseDomain splits a fully qualified name into its zone, which is assumed
+// to be the last two labels, and the subdomain within that zone. A name of
+// two labels is the apex of its zone.
+func ParseDomain(name string) (Domain, error) {
+	parts := strings.Split(strings.TrimSuffix(name, "."), ".")
+	if len(parts) < 2 || slices.Contains(parts, "") {
+		return Domain{}, fmt.Errorf("too few domain labels in %q", name)
+	}
+	if len(parts) == 2 {
+		return Domain{Zone: strings.Join(parts, "."), Subdomain: "@"}, nil
+	}
+	return Domain{
+		Zone:      strings.Join(parts[len(parts)-2:], "."),
+		Subdomain: strings.Join(parts[:len(parts)-2], "."),
+	}, nil
+}
+
+// ResolveDomains splits each of names into its zone and subdomain, using the
+// zones from lister if it's non-nil and they can be listed.
+func ResolveDomains(ctx context.Context, lister libdns.ZoneLister, names []string) ([]Domain, error) {
+	var zones []string
+	if lister != nil {
+		all, err := lister.ListZones(ctx)
+		if err != nil {
+			Logger(ctx).Warn("could not list zones, assuming each zone is the last two labels of the domain", "err", err)
+		}
+		for _, z := range all {
+			zones = append(zones, strings.TrimSuffix(z.Name, "."))
+		}
+		if err == nil {
+			Logger(ctx).Debug("listed zones", "zones", zones)
+		}
+	}
+	var domains []Domain
+	for _, name := range names {
+		var d Domain
+		var err error
+		if zones != nil {
+			d, err = matchZone(name, zones)
+		} else {
+			d, err = ParseDomain(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// matchZone finds the longest of zones that name is in and splits name into
+// that zone and the subdomain within it.
+func matchZone(name string, zones []string) (Domain, error) {
+	name = strings.TrimSuffix(name, ".")
+	var best string
+	for _, zone := range zones {
+		if (name == zone || strings.HasSuffix(name, "."+zone)) && len(zone) > len(best) {
+			best = zone
+		}
+	}
+	if best == "" {
+		return Domain{}, fmt.Errorf("no zone in the account contains %q", name)
+	}
+	if best == name {
+		return Domain{Zone: best, Subdomain: "@"}, nil
+	}
+	return Domain{Zone: best, Subdomain: strings.TrimSuffix(name, "."+best)}, nil
+}
+
+// groupByZone groups domains by their zone, returning the zones in the order
+// they first appear.
+func groupByZone(domains []Domain) ([]string, map[string][]Domain) {
+	var zones []string
+	byZone := make(map[string][]Domain)
+	for _, d := range domains {
+		if _, ok := byZone[d.Zone]; !ok {
+			zones = append(zones, d.Zone)
+		}
+		byZone[d.Zone] = append(byZone[d.Zone], d)
+	}
+	return zones, byZone
+}
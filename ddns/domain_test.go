@@ -0,0 +1,60 @@
+package ddns
+
+import "testing"
+
+func TestParseDomain(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		zone, subdomain string
+	}{
+		{"example.com", "example.com", "@"},
+		{"example.com.", "example.com", "@"},
+		{"sub.example.com", "example.com", "sub"},
+		{"a.b.example.com", "example.com", "a.b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := ParseDomain(tc.name)
+			if err != nil {
+				t.Fatalf("ParseDomain() failed: %v", err)
+			}
+			if d.Zone != tc.zone || d.Subdomain != tc.subdomain {
+				t.Errorf("ParseDomain() = %q in %q, want %q in %q", d.Subdomain, d.Zone, tc.subdomain, tc.zone)
+			}
+		})
+	}
+	for _, name := range []string{"com", "", "a..example.com"} {
+		if d, err := ParseDomain(name); err == nil {
+			t.Errorf("ParseDomain(%q) = %+v, want an error", name, d)
+		}
+	}
+}
+
+func TestMatchZone(t *testing.T) {
+	zones := []string{"co.uk", "example.co.uk", "example.com"}
+	for _, tc := range []struct {
+		name            string
+		zone, subdomain string
+	}{
+		{"example.co.uk", "example.co.uk", "@"},
+		{"home.example.co.uk", "example.co.uk", "home"},
+		{"a.b.example.co.uk", "example.co.uk", "a.b"},
+		{"other.co.uk", "co.uk", "other"},
+		{"sub.example.com.", "example.com", "sub"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := matchZone(tc.name, zones)
+			if err != nil {
+				t.Fatalf("matchZone() failed: %v", err)
+			}
+			if d.Zone != tc.zone || d.Subdomain != tc.subdomain {
+				t.Errorf("matchZone() = %q in %q, want %q in %q", d.Subdomain, d.Zone, tc.subdomain, tc.zone)
+			}
+		})
+	}
+	// A zone only matches whole labels.
+	for _, name := range []string{"notexample.com", "example.org"} {
+		if d, err := matchZone(name, zones); err == nil {
+			t.Errorf("matchZone(%q) = %+v, want an error", name, d)
+		}
+	}
+}
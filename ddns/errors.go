@@ -0,0 +1,60 @@
+package ddns
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Kind is the kind of failure an Error reports.
+type Kind int
+
+const (
+	// KindDetect means no address could be detected.
+	KindDetect Kind = iota + 1
+	// KindAPI means the DNS provider failed.
+	KindAPI
+	// KindAuth means the DNS provider rejected the credentials, or they
+	// don't grant access to a zone.
+	KindAuth
+	// KindPartial means some records were published but others failed.
+	KindPartial
+)
+
+// Error is an error returned by the Updater, marked with the kind of
+// failure so that callers can tell them apart with errors.As.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+func detectError(err error) error  { return &Error{Kind: KindDetect, Err: err} }
+func partialError(err error) error { return &Error{Kind: KindPartial, Err: err} }
+
+// APIError marks err, returned by a provider, as a failure of the provider, or
+// as an authentication failure if the provider rejected the credentials.
+func APIError(err error) error {
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &Error{Kind: KindAuth, Err: err}
+		}
+	}
+	return &Error{Kind: KindAPI, Err: err}
+}
+
+// zoneError marks err, from changing the records of zone, like APIError. If
+// the credentials were rejected, it explains what to check.
+func zoneError(zone string, err error) error {
+	e := APIError(err).(*Error)
+	if e.Kind == KindAuth {
+		e.Err = fmt.Errorf("zone %v: the API token was rejected or can't edit this zone; check that it is valid and has the Zone.DNS edit permission for %v: %w", zone, zone, err)
+	} else {
+		e.Err = fmt.Errorf("zone %v: %w", zone, err)
+	}
+	return e
+}
@@ -0,0 +1,48 @@
+package ddns
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// ToASCII returns name lowercased, with its labels that aren't plain ASCII
+// encoded with punycode, as the DNS and the provider APIs need them. A name
+// that isn't plain ASCII is mapped and checked with the IDNA lookup profile,
+// which also normalizes it to NFC, so it fails if the name has characters
+// that can't be in a host name. Plain ASCII names are only lowercased, which
+// keeps names like "@" and "_service" working.
+func ToASCII(name string) (string, error) {
+	if isASCII(name) {
+		return strings.ToLower(name), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid international domain name %q: %w", name, err)
+	}
+	return ascii, nil
+}
+
+// ToUnicode returns name with its punycode labels decoded, to show it as it
+// was given. A name that can't be decoded is kept as it is.
+func ToUnicode(name string) string {
+	if !strings.Contains(strings.ToLower(name), "xn--") {
+		return name
+	}
+	u, err := idna.Lookup.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return u
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestCloudflareIntegration runs an update against the live Cloudflare API,
+// with a throwaway name in the zone DYNCF_TEST_ZONE. It only runs with
+// DYNCF_INTEGRATION=1 and a CLOUDFLARE_API_TOKEN that can edit the zone.
+func TestCloudflareIntegration(t *testing.T) {
+	if os.Getenv("DYNCF_INTEGRATION") != "1" {
+		t.Skip("set DYNCF_INTEGRATION=1 to run against the live Cloudflare API")
+	}
+	token, zone := os.Getenv("CLOUDFLARE_API_TOKEN"), os.Getenv("DYNCF_TEST_ZONE")
+	if token == "" || zone == "" {
+		t.Fatal("CLOUDFLARE_API_TOKEN and DYNCF_TEST_ZONE must be set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	c := &CloudflareClient{Token: token}
+	d := Domain{Zone: zone, Subdomain: fmt.Sprintf("dyncf-test-%08x", rand.Uint32()), TTL: AutoTTL, RecordTypes: []string{"A"}}
+	updater := func(ip net.IP) *Updater {
+		return &Updater{
+			Provider:    c,
+			Cloudflare:  c,
+			Source:      StaticSource{"A": {ip}},
+			Domains:     []Domain{d},
+			RecordTypes: []string{"A"},
+			// The documentation ranges aren't public.
+			AllowPrivate: true,
+		}
+	}
+	t.Cleanup(func() {
+		// The test's context may be done by now.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := updater(nil).Delete(ctx); err != nil {
+			t.Errorf("could not delete %s: %v", d.Name(), err)
+		}
+	})
+
+	for _, step := range []struct {
+		name string
+		ip   net.IP
+	}{
+		{"create", net.IPv4(192, 0, 2, 1)},
+		{"update", net.IPv4(192, 0, 2, 2)},
+	} {
+		u := updater(step.ip)
+		if err := u.Update(ctx); err != nil {
+			t.Fatalf("%s: Update() failed: %v", step.name, err)
+		}
+		changes, err := u.Check(ctx)
+		if err != nil {
+			t.Fatalf("%s: Check() failed: %v", step.name, err)
+		}
+		if len(changes) != 0 {
+			t.Errorf("%s: Check() = %+v, want no changes", step.name, changes)
+		}
+	}
+
+	if err := updater(nil).Delete(ctx); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	records, err := c.GetRecords(ctx, zone)
+	if err != nil {
+		t.Fatalf("GetRecords() failed: %v", err)
+	}
+	for _, r := range records {
+		if sameName(r.Name, d.Subdomain) {
+			t.Errorf("record %+v is left after Delete()", r)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package ddns
+
+import (
+	"context"
+	"log/slog"
+)
+
+// loggerKey is the context key of the logger returned by Logger.
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying l, which is then used to log
+// everything done with the context.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Logger returns the logger carried by ctx, or the default logger.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,11 @@
+package ddns
+
+import "github.com/libdns/libdns"
+
+// Provider is the part of libdns that the Updater uses to manage records.
+type Provider interface {
+	libdns.RecordGetter
+	libdns.RecordAppender
+	libdns.RecordSetter
+	libdns.RecordDeleter
+}
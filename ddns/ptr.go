@@ -0,0 +1,129 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// reverseName returns the name of the PTR record of addr, in in-addr.arpa
+// for IPv4 and ip6.arpa for IPv6.
+func reverseName(addr net.IP) string {
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	var b strings.Builder
+	for i := len(addr) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", addr[i]&0xf, addr[i]>>4)
+	}
+	return b.String() + "ip6.arpa"
+}
+
+// updatePTR points the PTR records of addrs, the addresses detected for each
+// record type, back at the domains that publish them. The reverse zones must
+// be delegated to the account, so that ReverseZones lists them, and are
+// written with the Updater's provider.
+func (u *Updater) updatePTR(ctx context.Context, addrs map[string][]net.IP) (summary, error) {
+	var sum summary
+	var records []libdns.Record
+	for _, d := range u.Domains {
+		for _, recordType := range d.RecordTypes {
+			for _, addr := range addrs[recordType] {
+				records = append(records, libdns.Record{Type: "PTR", Name: reverseName(addr), Value: d.Name(), TTL: d.TTL})
+			}
+		}
+	}
+	if len(records) == 0 {
+		return sum, nil
+	}
+	groups := groupRecords(records)
+	stale := slices.ContainsFunc(groups, func(g []libdns.Record) bool {
+		return u.State.get(g[0].Name, "PTR") != joinValues(g)
+	})
+	if !stale && !u.Force {
+		Logger(ctx).Info("reverse records unchanged since last run, skipping update")
+		for _, rec := range records {
+			u.report(ctx, "", rec, rec.Value, StatusUnchanged)
+		}
+		sum.unchanged = len(records)
+		return sum, nil
+	}
+
+	zones, err := u.listReverseZones(ctx)
+	if err != nil {
+		for _, rec := range records {
+			u.report(ctx, "", rec, "", StatusFailed)
+		}
+		return sum, err
+	}
+	var errs []error
+	var reverse []Domain
+	byZone := make(map[string][]libdns.Record)
+	for _, g := range groups {
+		d, err := matchZone(g[0].Name, zones)
+		if err != nil {
+			for _, rec := range g {
+				u.report(ctx, "", rec, "", StatusFailed)
+			}
+			errs = append(errs, fmt.Errorf("could not find the reverse zone of %v: %w", g[0].Name, err))
+			continue
+		}
+		d.TTL, d.RecordTypes = g[0].TTL, []string{"PTR"}
+		reverse = append(reverse, d)
+		for _, rec := range g {
+			rec.Name = d.Subdomain
+			byZone[d.Zone] = append(byZone[d.Zone], rec)
+		}
+	}
+	names, domains := groupByZone(reverse)
+	for _, zone := range names {
+		zsum, ok, err := u.updateZone(ctx, zone, domains[zone], byZone[zone])
+		sum.add(zsum)
+		if err != nil {
+			Logger(ctx).Error("could not update reverse zone", "zone", zone, "err", err)
+			errs = append(errs, zoneError(zone, err))
+		}
+		if !slices.Contains(ok, "PTR") || u.DryRun {
+			continue
+		}
+		for _, g := range groupRecords(byZone[zone]) {
+			u.State.set(libdns.AbsoluteName(g[0].Name, zone), "PTR", joinValues(g))
+		}
+	}
+	return sum, errors.Join(errs...)
+}
+
+// listReverseZones returns the names of the zones listed by ReverseZones.
+func (u *Updater) listReverseZones(ctx context.Context) ([]string, error) {
+	if u.ReverseZones == nil {
+		return nil, errors.New("managing PTR records needs a provider that can list zones")
+	}
+	var zones []string
+	err := u.ReadRetry.do(ctx, "list zones", func() error {
+		all, err := u.ReverseZones.ListZones(ctx)
+		zones = nil
+		for _, z := range all {
+			zones = append(zones, strings.TrimSuffix(z.Name, "."))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list zones to find the reverse zones: %w", err)
+	}
+	return zones, nil
+}
+
+// joinValues returns the values of records joined by commas, as they are
+// remembered in State.
+func joinValues(records []libdns.Record) string {
+	values := make([]string, len(records))
+	for i, rec := range records {
+		values[i] = rec.Value
+	}
+	return strings.Join(values, ",")
+}
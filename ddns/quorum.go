@@ -0,0 +1,72 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// WithQuorum makes the sources of a chain from ParseIPSources be queried
+// together instead of in order, and only returns an address that at least
+// quorum of them agree on, so that one misbehaving source can't publish a
+// wrong address. It fails if source doesn't have that many sources. A quorum
+// of zero or one returns source as it is.
+func WithQuorum(source IPSource, quorum int) (IPSource, error) {
+	if quorum <= 1 {
+		return source, nil
+	}
+	chain, _ := source.(sourceChain)
+	if len(chain) < quorum {
+		return nil, fmt.Errorf("a quorum of %d needs at least as many ip sources", quorum)
+	}
+	return quorumSource{sources: chain, quorum: quorum}, nil
+}
+
+// quorumSource is a source made by WithQuorum.
+type quorumSource struct {
+	sources []IPSource
+	quorum  int
+}
+
+func (s quorumSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	addrs := make([]net.IP, len(s.sources))
+	errs := make([]error, len(s.sources))
+	var wg sync.WaitGroup
+	for i, src := range s.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs[i], errs[i] = src.DetectIP(ctx, recordType)
+		}()
+	}
+	wg.Wait()
+
+	votes := make(map[string]int)
+	var best net.IP
+	for i, addr := range addrs {
+		if errs[i] != nil {
+			if errors.Is(errs[i], ErrCircuitOpen) {
+				Logger(ctx).Debug("ip source skipped", "source", s.sources[i], "type", recordType, "err", errs[i])
+			} else {
+				Logger(ctx).Warn("ip source failed", "source", s.sources[i], "type", recordType, "err", errs[i])
+			}
+			continue
+		}
+		votes[addr.String()]++
+		if best == nil || votes[addr.String()] > votes[best.String()] {
+			best = addr
+		}
+	}
+	if best == nil {
+		return nil, errors.Join(errs...)
+	}
+	if len(votes) > 1 {
+		Logger(ctx).Warn("ip sources disagree", "type", recordType, "votes", votes)
+	}
+	if votes[best.String()] < s.quorum {
+		return nil, fmt.Errorf("no quorum for the %v address: at most %d of %d ip sources agree, on %v, but %d must", recordType, votes[best.String()], len(s.sources), best, s.quorum)
+	}
+	return best, nil
+}
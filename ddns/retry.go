@@ -0,0 +1,117 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retrier retries operations that fail with transient errors, backing off
+// exponentially between attempts.
+type Retrier struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// do calls f until it succeeds, fails with an error that isn't worth
+// retrying, runs out of retries, or ctx is done.
+func (r Retrier) do(ctx context.Context, op string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= r.MaxRetries || !isRetryable(err) {
+			return err
+		}
+		delay := r.backoff(attempt)
+		var rl *rateLimitError
+		if errors.As(err, &rl) && rl.retryAfter > delay {
+			delay = min(rl.retryAfter, maxRetryAfter)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		Logger(ctx).Warn("retrying", "op", op, "attempt", attempt+1, "delay", delay, "err", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the retry following attempt, doubling
+// each time up to MaxDelay. Half of the delay is random so that clients
+// which failed together don't retry together.
+func (r Retrier) backoff(attempt int) time.Duration {
+	d := r.BaseDelay << attempt
+	if d <= 0 || d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// maxRetryAfter caps how long a Retry-After header can make a retry wait.
+const maxRetryAfter = 5 * time.Minute
+
+// httpError is an API response with an error status. CloudflareClient and
+// DesecClient return it, so that errors can be classified by their status.
+type httpError struct {
+	StatusCode int
+	// msg is what the response said about the error.
+	msg string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("got error status: HTTP %d: %s", e.StatusCode, e.msg)
+}
+
+// rateLimitError is a rate limited response whose Retry-After header said
+// how long to wait before retrying. CloudflareClient and DesecClient return
+// it for any of their requests, wrapping the httpError.
+type rateLimitError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *rateLimitError) Error() string { return e.err.Error() }
+func (e *rateLimitError) Unwrap() error { return e.err }
+
+// parseRetryAfter returns the wait given by a Retry-After header, which is
+// either a number of seconds or an HTTP date, or 0 if there is none.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return max(0, time.Duration(secs)*time.Second)
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return max(0, t.Sub(now))
+	}
+	return 0
+}
+
+// isRetryable reports whether err is likely to be transient: a network
+// failure, a rate limit, or a server error.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var httpErr *httpError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+}
@@ -0,0 +1,110 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-5", 0},
+		{"Wed, 14 Oct 2026 12:01:00 GMT", time.Minute},
+		{"Wed, 14 Oct 2026 11:00:00 GMT", 0},
+		{"soon", 0},
+	} {
+		if got := parseRetryAfter(tc.header, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &httpError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"rate limit", &rateLimitError{time.Second, &httpError{StatusCode: http.StatusTooManyRequests}}, true},
+		{"wrapped server error", fmt.Errorf("zone example.com: %w", &httpError{StatusCode: http.StatusBadGateway}), true},
+		{"bad request mentioning a status", &httpError{StatusCode: http.StatusBadRequest, msg: "content HTTP 503 is invalid"}, false},
+		{"other error mentioning a status", errors.New("got HTTP 503 in a comment"), false},
+		{"canceled", context.Canceled, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryable(tc.err); got != tc.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAPIErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want Kind
+	}{
+		{&httpError{StatusCode: http.StatusForbidden}, KindAuth},
+		{fmt.Errorf("zone example.com: %w", &httpError{StatusCode: http.StatusUnauthorized}), KindAuth},
+		{&httpError{StatusCode: http.StatusNotFound, msg: "HTTP 403"}, KindAPI},
+		{errors.New("got error status: HTTP 401"), KindAPI},
+	} {
+		if got := APIError(tc.err).(*Error).Kind; got != tc.want {
+			t.Errorf("APIError(%v) has kind %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryAfterOnRecordWrite(t *testing.T) {
+	var creates atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && creates.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"success":false,"errors":[{"code":971,"message":"Please wait and consider throttling your request speed"}]}`, http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"success":true,"result":{"id":"zone1"}}`))
+	}))
+	defer srv.Close()
+	c := &CloudflareClient{Token: "token", baseURL: srv.URL}
+	c.zoneIDs = map[string]string{"example.com": "zone1"}
+	rec := libdns.Record{Type: "A", Name: "home", Value: "192.0.2.1", TTL: AutoTTL}
+	ctx := context.Background()
+
+	_, err := c.AppendRecords(ctx, "example.com", []libdns.Record{rec})
+	var rl *rateLimitError
+	if !errors.As(err, &rl) || rl.retryAfter != time.Second {
+		t.Fatalf("AppendRecords() = %v, want a rate limit error asking to wait 1s", err)
+	}
+	if !isRetryable(err) {
+		t.Errorf("isRetryable(%v) = false, want true", err)
+	}
+
+	// A retry waits for the Retry-After rather than the shorter backoff.
+	creates.Store(0)
+	start := time.Now()
+	err = Retrier{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}.do(ctx, "create records", func() error {
+		_, err := c.AppendRecords(ctx, "example.com", []libdns.Record{rec})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("retried AppendRecords() failed: %v", err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retry waited %v, want at least the 1s of Retry-After", waited)
+	}
+}
@@ -0,0 +1,84 @@
+package ddns
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// State remembers what was last published, so that a run can tell that
+// nothing changed without asking the provider. A nil *State remembers
+// nothing.
+type State struct {
+	path string
+	// Published maps each domain name to the value last published for
+	// each record type.
+	Published map[string]map[string]string `json:"published"`
+}
+
+// LoadState reads the state file at path. A missing or corrupt file is
+// treated as if nothing was published yet.
+func LoadState(path string) *State {
+	s := &State{path: path, Published: make(map[string]map[string]string)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s
+	}
+	if err == nil {
+		err = json.Unmarshal(b, s)
+	}
+	if err != nil {
+		slog.Warn("ignoring unreadable state file", "path", path, "err", err)
+		s.Published = make(map[string]map[string]string)
+	}
+	if s.Published == nil {
+		s.Published = make(map[string]map[string]string)
+	}
+	return s
+}
+
+// get returns the value last published for the record, or "" if unknown.
+func (s *State) get(name, recordType string) string {
+	if s == nil {
+		return ""
+	}
+	return s.Published[name][recordType]
+}
+
+// set records that value was published for the record.
+func (s *State) set(name, recordType, value string) {
+	if s == nil {
+		return
+	}
+	if s.Published[name] == nil {
+		s.Published[name] = make(map[string]string)
+	}
+	s.Published[name][recordType] = value
+}
+
+// save writes the state back to its file, replacing it atomically.
+func (s *State) save() error {
+	if s == nil {
+		return nil
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,191 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultSTUNServer is the server queried by the "stun" source unless another
+// one is configured.
+const DefaultSTUNServer = "stun.cloudflare.com:3478"
+
+// STUN message types and attributes, from RFC 5389.
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+)
+
+// stunSource asks a STUN server for the address it sees requests coming from,
+// which works on networks that block HTTP detection.
+type stunSource struct {
+	server string
+	f      *Fetcher
+}
+
+func (s stunSource) String() string { return "stun:" + s.server }
+
+func (s stunSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	var network string
+	switch recordType {
+	case "A":
+		network = "udp4"
+	case "AAAA":
+		network = "udp6"
+	default:
+		return nil, fmt.Errorf("unknown record type %v", recordType)
+	}
+	if s.f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.f.Timeout)
+		defer cancel()
+	}
+	d := &net.Dialer{Resolver: s.f.Resolver}
+	if local := s.f.Local[recordType]; local != nil {
+		d.LocalAddr = &net.UDPAddr{IP: local}
+	}
+	conn, err := d.DialContext(ctx, network, s.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	resp, err := stunExchange(ctx, conn, req, stunRTO)
+	if err != nil {
+		return nil, wrapTimeout(err)
+	}
+	addr, err := parseSTUNResponse(resp, req[8:20])
+	if err != nil {
+		return nil, err
+	}
+	Logger(ctx).Debug("got stun response", "server", s.server, "type", recordType, "addr", addr)
+	return addr, checkFamily(addr, recordType)
+}
+
+// The retransmissions of a request, from RFC 5389, section 7.2.1. The
+// request is sent up to stunTries times, waiting stunRTO for a response to
+// the first one and twice as long after each other, except that the last
+// one gets 16 times stunRTO. That's 39.5 seconds in all.
+const (
+	stunRTO   = 500 * time.Millisecond
+	stunTries = 7
+)
+
+// stunExchange sends req over conn until a response with its transaction ID
+// arrives, ctx is done, or the tries run out, as UDP requests can be lost.
+// The first try waits rto for a response.
+func stunExchange(ctx context.Context, conn net.Conn, req []byte, rto time.Duration) ([]byte, error) {
+	buf := make([]byte, 1500)
+	wait := rto
+	for try := 1; ; try++ {
+		if try == stunTries {
+			wait = 16 * rto
+		}
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(wait)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+				if try == stunTries {
+					return nil, fmt.Errorf("no stun response after %d tries: %w", stunTries, err)
+				}
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n >= 20 && bytes.Equal(buf[8:20], req[8:20]) {
+				return buf[:n], nil
+			}
+		}
+		wait *= 2
+	}
+}
+
+// parseSTUNResponse returns the mapped address in resp, the response to the
+// binding request with transaction ID id.
+func parseSTUNResponse(resp, id []byte) (net.IP, error) {
+	if binary.BigEndian.Uint16(resp[0:]) != stunBindingResponse {
+		return nil, fmt.Errorf("unexpected stun message type %#04x", binary.BigEndian.Uint16(resp[0:]))
+	}
+	attrs := resp[20:]
+	if n := int(binary.BigEndian.Uint16(resp[2:])); n <= len(attrs) {
+		attrs = attrs[:n]
+	}
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		attrType, n := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+n > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+n]
+		switch attrType {
+		case stunXORMappedAddress:
+			// The address is XORed with the magic cookie followed by
+			// the transaction ID.
+			key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+			key = append(key, id...)
+			if addr := stunAddress(value, key); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = stunAddress(value, nil)
+		}
+		// Attributes are padded to a multiple of 4 bytes.
+		attrs = attrs[min(len(attrs), 4+(n+3)&^3):]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, errors.New("no mapped address in stun response")
+}
+
+// stunAddress decodes the address of a MAPPED-ADDRESS style attribute value,
+// XORed with key if it's non-nil. It returns nil if value is malformed.
+func stunAddress(value, key []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+size {
+		return nil
+	}
+	addr := make(net.IP, size)
+	copy(addr, value[4:4+size])
+	if key != nil {
+		for i := range addr {
+			addr[i] ^= key[i]
+		}
+	}
+	return addr
+}
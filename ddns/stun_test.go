@@ -0,0 +1,78 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveSTUN starts a UDP server that drops the first drop requests and echoes
+// the others back, which is enough for stunExchange, and returns a
+// connection to it and the count of the requests it got.
+func serveSTUN(t *testing.T, drop int) (net.Conn, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var got atomic.Int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if int(got.Add(1)) > drop {
+				pc.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	conn, err := net.Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, &got
+}
+
+func TestSTUNExchangeRetries(t *testing.T) {
+	conn, got := serveSTUN(t, 2)
+	req := make([]byte, 20)
+	copy(req[8:], "transaction1")
+
+	resp, err := stunExchange(context.Background(), conn, req, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("stunExchange() failed: %v", err)
+	}
+	if len(resp) != len(req) {
+		t.Errorf("stunExchange() = %q, want the echoed request", resp)
+	}
+	if n := got.Load(); n != 3 {
+		t.Errorf("server got %d requests, want 3", n)
+	}
+}
+
+func TestSTUNExchangeGivesUp(t *testing.T) {
+	conn, got := serveSTUN(t, stunTries+1)
+	req := make([]byte, 20)
+	copy(req[8:], "transaction1")
+
+	start := time.Now()
+	resp, err := stunExchange(context.Background(), conn, req, time.Millisecond)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("stunExchange() = %q, %v, want a timeout", resp, err)
+	}
+	// 1+2+4+8+16+32 ms for the first tries and 16 ms for the last one.
+	if elapsed := time.Since(start); elapsed < 79*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("stunExchange() gave up after %v, want about 79ms", elapsed)
+	}
+	if n := got.Load(); n != stunTries {
+		t.Errorf("server got %d requests, want %d", n, stunTries)
+	}
+}
@@ -0,0 +1,1099 @@
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// Cloudflare's accepted TTL range for records that aren't proxied.
+const (
+	MinTTL = time.Minute
+	MaxTTL = 24 * time.Hour
+)
+
+// AutoTTL is the TTL of Cloudflare records set to "Auto", as the provider
+// reads it back.
+const AutoTTL = time.Second
+
+// Updater publishes the current addresses of this host to a set of names.
+type Updater struct {
+	Provider Provider
+	// Cloudflare is used for Cloudflare specific settings, like proxying.
+	// It may be nil for other providers.
+	Cloudflare *CloudflareClient
+	Source     IPSource
+	Domains    []Domain
+	// RecordTypes are the record types published for any of Domains. The
+	// values of address types are detected, and those of the others are
+	// taken from Fixed.
+	RecordTypes []string
+	// Fixed maps record types that aren't addresses, like CNAME and TXT, to
+	// the value to publish for them.
+	Fixed map[string]string
+	// SRV describes the records published for the SRV type, if it's one of
+	// RecordTypes.
+	SRV *SRV
+	// Comment, if set, is given to the Cloudflare records that are
+	// written, with {time} replaced by the time of the write. It's ignored
+	// without Cloudflare, and never compared, so it doesn't cause writes.
+	Comment string
+	// SyncTTL rewrites records whose TTL differs from the domain's.
+	// Otherwise only their values are compared. The TTL of records that
+	// Cloudflare proxies is never compared, as it's always reported as auto.
+	SyncTTL bool
+	// SyncProxied rewrites records whose proxying differs from the
+	// domain's, which needs Cloudflare. Otherwise existing records keep
+	// their proxying unless the domain is proxied.
+	SyncProxied bool
+	Retry       Retrier
+	// ReadRetry is the retry policy for reading the existing records, and
+	// ReadTimeout, if non-zero, bounds the read including its retries.
+	ReadRetry   Retrier
+	ReadTimeout time.Duration
+	// WriteOnReadFailure writes the records without comparing them if the
+	// existing records can't be read, instead of failing the zone.
+	WriteOnReadFailure bool
+	// Concurrency is the most zones updated at once. Zero means one at a
+	// time.
+	Concurrency int
+	// AllowPrivate allows publishing addresses that aren't reachable from
+	// the internet, like private or CGNAT addresses.
+	AllowPrivate bool
+	// AllowNets, if not empty, are the only ranges that addresses are
+	// published from.
+	AllowNets []*net.IPNet
+	// RequireConsistent publishes nothing if both A and AAAA records are
+	// wanted but only one of them could be detected, which is otherwise
+	// only a warning.
+	RequireConsistent bool
+	// Debounce, if non-zero, is how long newly detected addresses must stay
+	// the same before they replace those of a previous update, so that
+	// brief reconnections aren't published.
+	Debounce time.Duration
+	// DryRun logs the records that would be changed instead of setting them.
+	DryRun bool
+	// Force rewrites records even if they already have the wanted values.
+	Force bool
+	// Append only creates the wanted records that are missing, keeping any
+	// other values of the same names and types instead of replacing or
+	// deleting them.
+	Append bool
+	// CreateOnly only creates the records of names and types that have
+	// none, leaving those that exist as they are whatever their values.
+	CreateOnly bool
+	// OnMissing is what happens to wanted records whose name and type have
+	// none yet: MissingCreate, the default, creates them, MissingWarn
+	// also logs a warning, and MissingFail fails them instead, for setups
+	// where the records are expected to exist already.
+	OnMissing string
+	// ManagePTR also points the PTR records of the detected addresses back
+	// at the domains that publish them. Their reverse zones are found with
+	// ReverseZones.
+	ManagePTR    bool
+	ReverseZones libdns.ZoneLister
+
+	// State remembers what was published by previous runs, if set.
+	State *State
+	// BeforeChange, if set, is called before each record is changed, except
+	// in a dry run. If it returns an error, the record is left as it is.
+	BeforeChange func(ctx context.Context, c Change) error
+	// OnChange, if set, is called for every changed record. It may be
+	// called concurrently for records in different zones, as may
+	// BeforeChange.
+	OnChange func(ctx context.Context, c Change)
+	// OnResult, if set, is called with the outcome of every record of an
+	// update, including those that were unchanged or failed. It may be
+	// called concurrently, like OnChange.
+	OnResult func(ctx context.Context, r Result)
+	// OnAddressChange, if set, is called when the detected addresses of
+	// recordType differ from those of the previous update.
+	OnAddressChange func(recordType string, old, new []net.IP)
+	// OnDetect, if set, is called with the usable addresses detected by
+	// every update, by record type.
+	OnDetect func(addrs map[string][]net.IP)
+
+	// lastAddrs are the addresses detected by the previous update.
+	lastAddrs map[string][]net.IP
+	// settledAddrs are the addresses last accepted for each record type
+	// with Debounce, and candidates those waiting to settle.
+	settledAddrs map[string][]net.IP
+	candidates   map[string]candidate
+}
+
+// Inherit takes over what prev remembers of its updates, like the addresses
+// it last detected, so that u can replace it, e.g. with new settings, without
+// starting afresh. It must not be called during an update of either.
+func (u *Updater) Inherit(prev *Updater) {
+	u.lastAddrs, u.settledAddrs, u.candidates = prev.lastAddrs, prev.settledAddrs, prev.candidates
+}
+
+// candidate is a change of the detected addresses that is waiting for
+// Debounce.
+type candidate struct {
+	addrs []net.IP
+	since time.Time
+}
+
+// Check detects the current addresses and returns the changes that Update
+// would make, without making them. It only reads the records, and ignores
+// State, Force, WriteOnReadFailure and Debounce.
+func (u *Updater) Check(ctx context.Context) ([]Change, error) {
+	var mu sync.Mutex
+	var changes []Change
+	c := *u
+	c.DryRun, c.Force, c.State, c.WriteOnReadFailure, c.Debounce = true, false, nil, false, 0
+	c.OnResult = func(ctx context.Context, r Result) {
+		if u.OnResult != nil {
+			u.OnResult(ctx, r)
+		}
+		if r.Status != StatusDryRun {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, r.Change)
+	}
+	err := c.Update(ctx)
+	u.lastAddrs = c.lastAddrs
+	return changes, err
+}
+
+// Update detects the current addresses and sets the records for every
+// domain. A failure to detect one record type or to update one zone does not
+// stop the others from being updated. Detection failures are only returned if
+// no record type could be published, and zone failures are always returned.
+func (u *Updater) Update(ctx context.Context) error {
+	var errs, detectErrs []error
+	var detected []string
+	addrs := make(map[string][]net.IP)
+	values := make(map[string][]string)
+	addrTypes := slices.DeleteFunc(slices.Clone(u.RecordTypes), func(t string) bool { return !IsAddressType(t) })
+	results := detectAll(ctx, u.Source, addrTypes)
+	for i, recordType := range addrTypes {
+		if err := results[i].err; err != nil {
+			Logger(ctx).Error("could not detect address", "type", recordType, "err", err)
+			detectErrs = append(detectErrs, detectError(fmt.Errorf("could not get %v address: %w", recordType, err)))
+			continue
+		}
+		var usable []net.IP
+		for _, addr := range results[i].addrs {
+			if err := CheckPublic(addr); err != nil && !u.AllowPrivate {
+				Logger(ctx).Warn("not publishing address", "type", recordType, "err", err)
+				continue
+			}
+			if err := checkAllowed(addr, u.AllowNets); err != nil {
+				Logger(ctx).Warn("not publishing address", "type", recordType, "err", err)
+				continue
+			}
+			usable = append(usable, addr)
+		}
+		if len(usable) == 0 {
+			Logger(ctx).Error("no usable address detected", "type", recordType)
+			detectErrs = append(detectErrs, detectError(fmt.Errorf("no usable %v address detected", recordType)))
+			continue
+		}
+		if !u.settled(ctx, recordType, usable) {
+			continue
+		}
+		detected = append(detected, recordType)
+		addrs[recordType] = usable
+		for _, addr := range usable {
+			values[recordType] = append(values[recordType], addr.String())
+		}
+		if last, ok := u.lastAddrs[recordType]; ok && !slices.EqualFunc(last, addrs[recordType], net.IP.Equal) {
+			Logger(ctx).Info("address changed", "type", recordType, "old", last, "new", addrs[recordType])
+			if u.OnAddressChange != nil {
+				u.OnAddressChange(recordType, last, addrs[recordType])
+			}
+		}
+	}
+	if len(addrTypes) > 0 {
+		// Log the families together, so that a mismatched pair is easy
+		// to spot.
+		Logger(ctx).Info("detected addresses", "A", addrs["A"], "AAAA", addrs["AAAA"])
+		if u.OnDetect != nil {
+			u.OnDetect(addrs)
+		}
+	}
+	if _, ok := addrs["A"]; slices.Contains(addrTypes, "A") && slices.Contains(addrTypes, "AAAA") && len(addrs) == 1 && len(detectErrs) > 0 {
+		missing := "AAAA"
+		if !ok {
+			missing = "A"
+		}
+		if u.RequireConsistent {
+			Logger(ctx).Error("only one address family detected, publishing nothing", "missing", missing)
+			detectErrs = append(detectErrs, detectError(fmt.Errorf("no %v address detected, and both families are required", missing)))
+			return errors.Join(detectErrs...)
+		}
+		Logger(ctx).Warn("only one address family detected", "missing", missing)
+	}
+	addrChanges := u.describeAddresses(addrTypes, values, u.lastAddrs)
+	u.lastAddrs = addrs
+	for _, recordType := range u.RecordTypes {
+		if v, ok := u.Fixed[recordType]; ok {
+			detected = append(detected, recordType)
+			values[recordType] = []string{v}
+		}
+	}
+	if u.SRV != nil && slices.Contains(u.RecordTypes, "SRV") {
+		detected = append(detected, "SRV")
+		values["SRV"] = []string{u.SRV.String()}
+	}
+	if len(detected) == 0 {
+		return errors.Join(detectErrs...)
+	}
+
+	zones, byZone := groupByZone(u.Domains)
+	zoneResults := make([]zoneResult, len(zones))
+	sem := make(chan struct{}, max(1, u.Concurrency))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		var records []libdns.Record
+		stale := false
+		for _, d := range byZone[zone] {
+			records = append(records, u.buildRecords(d, detected, values)...)
+			for _, recordType := range publishable(d, detected) {
+				if u.State.get(d.Name(), recordType) != strings.Join(values[recordType], ",") {
+					stale = true
+				}
+			}
+		}
+		if !stale && !u.Force {
+			Logger(ctx).Info("unchanged since last run, skipping update", "zone", zone)
+			for _, rec := range records {
+				u.report(ctx, zone, rec, rec.Value, StatusUnchanged)
+			}
+			zoneResults[i] = zoneResult{sum: summary{unchanged: len(records)}, skipped: true}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r := &zoneResults[i]
+			r.sum, r.ok, r.err = u.forZone(byZone[zone]).updateZone(ctx, zone, byZone[zone], records)
+		}()
+	}
+	wg.Wait()
+
+	var sum summary
+	failedDomains := 0
+	published := false
+	for i, zone := range zones {
+		r := zoneResults[i]
+		sum.add(r.sum)
+		if r.skipped || len(r.ok) > 0 {
+			published = true
+		}
+		if r.err != nil {
+			Logger(ctx).Error("could not update zone", "zone", zone, "err", r.err, "up_to_date_types", r.ok)
+			errs = append(errs, zoneError(zone, r.err))
+			failedDomains += len(byZone[zone])
+		}
+		if r.skipped || u.DryRun {
+			continue
+		}
+		// Only remember the types that were written, so that the others
+		// are retried next time.
+		for _, d := range byZone[zone] {
+			for _, recordType := range publishable(d, detected) {
+				if slices.Contains(r.ok, recordType) {
+					u.State.set(d.Name(), recordType, strings.Join(values[recordType], ","))
+				}
+			}
+		}
+	}
+	if u.ManagePTR {
+		psum, err := u.updatePTR(ctx, addrs)
+		sum.add(psum)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := u.State.save(); err != nil {
+		Logger(ctx).Warn("could not save state", "err", err)
+	}
+	Logger(ctx).Info("summary", "addresses", addrChanges, "domains", len(u.Domains), "failed_domains", failedDomains, "created", sum.created, "updated", sum.updated, "deleted", sum.deleted, "unchanged", sum.unchanged, "skipped", sum.skipped, "errors", len(errs), "dry_run", u.DryRun)
+	if len(errs) > 0 && published {
+		return partialError(errors.Join(errs...))
+	}
+	return errors.Join(errs...)
+}
+
+// forZone returns the updater to use for a zone whose domains are domains,
+// which is a copy of u with their provider if they have their own.
+func (u *Updater) forZone(domains []Domain) *Updater {
+	if domains[0].Provider == nil {
+		return u
+	}
+	zu := *u
+	zu.Provider, zu.Cloudflare = domains[0].Provider, domains[0].Cloudflare
+	return &zu
+}
+
+// describeAddresses says for each of addrTypes that has values whether they
+// changed since they were last published, as remembered by State, or else
+// since last, the addresses of the previous update, e.g.
+// "A unchanged (192.0.2.1), AAAA changed (2001:db8::1 -> 2001:db8::2)".
+func (u *Updater) describeAddresses(addrTypes []string, values map[string][]string, last map[string][]net.IP) string {
+	var parts []string
+	for _, recordType := range addrTypes {
+		v, ok := values[recordType]
+		if !ok {
+			continue
+		}
+		cur := strings.Join(v, ",")
+		old, known := u.previous(recordType, cur, last)
+		switch {
+		case !known:
+			parts = append(parts, fmt.Sprintf("%v %v (previous unknown)", recordType, cur))
+		case old == cur:
+			parts = append(parts, fmt.Sprintf("%v unchanged (%v)", recordType, cur))
+		default:
+			parts = append(parts, fmt.Sprintf("%v changed (%v -> %v)", recordType, old, cur))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// previous returns the addresses last published for recordType, preferring
+// those of a domain that differ from cur, and whether they are known.
+func (u *Updater) previous(recordType, cur string, last map[string][]net.IP) (string, bool) {
+	var found string
+	for _, d := range u.Domains {
+		if !slices.Contains(d.RecordTypes, recordType) {
+			continue
+		}
+		if v := u.State.get(d.Name(), recordType); v != "" {
+			if v != cur {
+				return v, true
+			}
+			found = v
+		}
+	}
+	if found != "" {
+		return found, true
+	}
+	addrs, ok := last[recordType]
+	if !ok {
+		return "", false
+	}
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ","), true
+}
+
+// zoneResult is the outcome of updating one zone.
+type zoneResult struct {
+	sum summary
+	ok  []string
+	err error
+	// skipped is set if the state showed that the zone was up to date.
+	skipped bool
+}
+
+// settled reports whether addrs, detected for recordType, can be published:
+// the first addresses detected are, and later ones once they have been
+// detected unchanged for Debounce.
+func (u *Updater) settled(ctx context.Context, recordType string, addrs []net.IP) bool {
+	if u.Debounce <= 0 {
+		return true
+	}
+	if u.settledAddrs == nil {
+		u.settledAddrs = make(map[string][]net.IP)
+		u.candidates = make(map[string]candidate)
+	}
+	last, ok := u.settledAddrs[recordType]
+	if !ok || slices.EqualFunc(last, addrs, net.IP.Equal) {
+		u.settledAddrs[recordType] = addrs
+		delete(u.candidates, recordType)
+		return true
+	}
+	c, ok := u.candidates[recordType]
+	if !ok || !slices.EqualFunc(c.addrs, addrs, net.IP.Equal) {
+		u.candidates[recordType] = candidate{addrs: addrs, since: time.Now()}
+		Logger(ctx).Info("address changed, waiting for it to settle", "type", recordType, "old", last, "new", addrs, "debounce", u.Debounce)
+		return false
+	}
+	if wait := u.Debounce - time.Since(c.since); wait > 0 {
+		Logger(ctx).Info("address not settled yet", "type", recordType, "new", addrs, "remaining", wait.Round(time.Second))
+		return false
+	}
+	u.settledAddrs[recordType] = addrs
+	delete(u.candidates, recordType)
+	return true
+}
+
+// summary counts the records affected by an update. In a dry run, it counts
+// the records that would have been affected.
+type summary struct {
+	created, updated, deleted, unchanged, skipped int
+}
+
+func (s *summary) add(o summary) {
+	s.created += o.created
+	s.updated += o.updated
+	s.deleted += o.deleted
+	s.unchanged += o.unchanged
+	s.skipped += o.skipped
+}
+
+// SRV describes SRV records that point at the domains they are published
+// for, at the name _Service._Proto within each domain.
+type SRV struct {
+	Service, Proto         string
+	Port, Priority, Weight uint
+}
+
+func (s SRV) String() string {
+	return fmt.Sprintf("_%v._%v %d %d %d", s.Service, s.Proto, s.Priority, s.Weight, s.Port)
+}
+
+// record returns the SRV record that points at d.
+func (s SRV) record(d Domain) libdns.Record {
+	return libdns.Record{
+		Type:     "SRV",
+		Name:     recordName(d, "SRV", &s),
+		Value:    fmt.Sprintf("%d %v", s.Port, d.Name()),
+		TTL:      d.TTL,
+		Priority: s.Priority,
+		Weight:   s.Weight,
+	}
+}
+
+// recordName returns the name relative to the zone of the records of
+// recordType for d, which is the name of d except for SRV records.
+func recordName(d Domain, recordType string, srv *SRV) string {
+	if recordType != "SRV" || srv == nil {
+		return d.Subdomain
+	}
+	prefix := fmt.Sprintf("_%v._%v", srv.Service, srv.Proto)
+	if d.Subdomain == "@" || d.Subdomain == "" {
+		return prefix
+	}
+	return prefix + "." + d.Subdomain
+}
+
+// buildRecords returns the records that publish the values of the record
+// types of d that are in detected.
+func (u *Updater) buildRecords(d Domain, detected []string, values map[string][]string) []libdns.Record {
+	var records []libdns.Record
+	for _, recordType := range publishable(d, detected) {
+		if recordType == "SRV" {
+			records = append(records, u.SRV.record(d))
+			continue
+		}
+		for _, v := range values[recordType] {
+			records = append(records, libdns.Record{
+				Type:  recordType,
+				Name:  d.Subdomain,
+				Value: v,
+				TTL:   d.TTL,
+			})
+		}
+	}
+	return records
+}
+
+// publishable returns the record types of d that are in detected.
+func publishable(d Domain, detected []string) []string {
+	return slices.DeleteFunc(slices.Clone(d.RecordTypes), func(t string) bool { return !slices.Contains(detected, t) })
+}
+
+// IsAddressType reports whether the values of records of recordType are
+// detected addresses.
+func IsAddressType(recordType string) bool {
+	return recordType == "A" || recordType == "AAAA"
+}
+
+// detection is the result of detecting the addresses for one record type.
+type detection struct {
+	addrs []net.IP
+	err   error
+}
+
+// detectAll detects the addresses for each of recordTypes concurrently,
+// returning the results in the same order.
+func detectAll(ctx context.Context, source IPSource, recordTypes []string) []detection {
+	results := make([]detection, len(recordTypes))
+	var wg sync.WaitGroup
+	for i, recordType := range recordTypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].addrs, results[i].err = DetectIPs(ctx, source, recordType)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Values of Updater.OnMissing.
+const (
+	MissingCreate = "create"
+	MissingWarn   = "warn"
+	MissingFail   = "fail"
+)
+
+// Statuses of a Result.
+const (
+	StatusCreated   = "created"
+	StatusUpdated   = "updated"
+	StatusDeleted   = "deleted"
+	StatusUnchanged = "unchanged"
+	// StatusSkipped is a record that CreateOnly didn't write because its
+	// name and type already had one, whose values are Old.
+	StatusSkipped = "skipped"
+	// StatusForced is a record that was rewritten with the same value
+	// because of Force.
+	StatusForced = "forced"
+	// StatusDryRun is a change that a dry run didn't make.
+	StatusDryRun = "dry_run"
+	// StatusRejected is a change that BeforeChange rejected.
+	StatusRejected = "rejected"
+	StatusFailed   = "failed"
+)
+
+// Result is the outcome of an update for one record. For a record that was
+// unchanged, Old and New are both its value.
+type Result struct {
+	Change
+	Status string `json:"status"`
+}
+
+// reportChange calls OnResult, if set, for c.
+func (u *Updater) reportChange(ctx context.Context, c Change, status string) {
+	if u.OnResult != nil {
+		u.OnResult(ctx, Result{Change: c, Status: status})
+	}
+}
+
+// report calls OnResult, if set, for rec in zone, whose previous value was
+// old.
+func (u *Updater) report(ctx context.Context, zone string, rec libdns.Record, old, status string) {
+	u.reportChange(ctx, Change{Domain: libdns.AbsoluteName(rec.Name, zone), Type: rec.Type, Old: old, New: rec.Value}, status)
+}
+
+// Change is a record whose value was changed by an update. Old is empty for
+// a created record, and New for a deleted one.
+type Change struct {
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+// zoneChanges are the writes needed to update the records of one type in a
+// zone.
+type zoneChanges struct {
+	set, add, del []libdns.Record
+	changes       []Change
+	// forced are the records of set that are rewritten only because of
+	// Force.
+	forced []Change
+	// rejected are the errors of the changes that BeforeChange rejected,
+	// or that OnMissing didn't allow.
+	rejected []error
+}
+
+// updateZone changes the records in zone to match records, which are those of
+// domains. For each name and type, records with values that are no longer
+// wanted are updated in place where possible, and otherwise deleted, while
+// new values are created. Each record type is written separately, so ok lists
+// the types that are up to date even if writing others failed.
+//
+// Only records with the names and types of records are written, and updates
+// always carry the ID of the existing record, since the provider's SetRecords
+// would otherwise look up a record to overwrite by itself. Other records in
+// the zone are never touched.
+func (u *Updater) updateZone(ctx context.Context, zone string, domains []Domain, records []libdns.Record) (sum summary, ok []string, err error) {
+	existing, err := u.getRecords(ctx, zone)
+	// Appending or creating without knowing the existing records would
+	// create duplicates, and could create records that must exist already.
+	if err != nil && u.WriteOnReadFailure && !u.Append && !u.CreateOnly && u.OnMissing != MissingFail {
+		Logger(ctx).Warn("could not get existing records, writing them without comparing", "zone", zone, "err", err)
+		return u.writeUnread(ctx, zone, domains, records)
+	}
+	if err != nil {
+		for _, rec := range records {
+			u.report(ctx, zone, rec, "", StatusFailed)
+		}
+		return sum, nil, fmt.Errorf("could not get existing records: %w", err)
+	}
+	Logger(ctx).Debug("got existing records", "zone", zone, "records", existing)
+	if err := checkConflicts(zone, existing, records); err != nil {
+		for _, rec := range records {
+			u.report(ctx, zone, rec, "", StatusFailed)
+		}
+		return sum, nil, err
+	}
+	var proxiedIDs map[string]bool
+	if (u.SyncProxied || u.SyncTTL) && u.Cloudflare != nil {
+		err := u.ReadRetry.do(ctx, "get proxying", func() error {
+			var err error
+			proxiedIDs, err = u.Cloudflare.proxiedRecords(ctx, zone)
+			return err
+		})
+		if err != nil {
+			for _, rec := range records {
+				u.report(ctx, zone, rec, "", StatusFailed)
+			}
+			return sum, nil, fmt.Errorf("could not get the proxying of the existing records: %w", err)
+		}
+	}
+	var types []string
+	byType := make(map[string]*zoneChanges)
+	for _, want := range groupRecords(records) {
+		name, recordType := want[0].Name, want[0].Type
+		zc, found := byType[recordType]
+		if !found {
+			zc = &zoneChanges{}
+			byType[recordType] = zc
+			types = append(types, recordType)
+		}
+		var have []libdns.Record
+		for _, r := range existing {
+			if r.Type == recordType && sameName(r.Name, name) {
+				have = append(have, r)
+			}
+		}
+		if u.CreateOnly && len(have) > 0 {
+			for _, rec := range want {
+				Logger(ctx).Info("record exists, leaving it", "zone", zone, "name", name, "type", recordType, "existing", joinValues(have), "value", rec.Value)
+				u.report(ctx, zone, rec, joinValues(have), StatusSkipped)
+			}
+			sum.skipped += len(want)
+			continue
+		}
+		if len(have) == 0 && u.OnMissing == MissingFail {
+			Logger(ctx).Error("record is missing, not creating it", "zone", zone, "name", name, "type", recordType)
+			for _, rec := range want {
+				u.report(ctx, zone, rec, "", StatusFailed)
+			}
+			zc.rejected = append(zc.rejected, fmt.Errorf("%v has no %v record", libdns.AbsoluteName(name, zone), recordType))
+			continue
+		}
+		if len(have) == 0 && u.OnMissing == MissingWarn {
+			Logger(ctx).Warn("record is missing, creating it", "zone", zone, "name", name, "type", recordType)
+		}
+		i := slices.IndexFunc(domains, func(d Domain) bool { return sameName(d.Subdomain, name) })
+		if i >= 0 && domains[i].KeepAutoTTL && slices.ContainsFunc(have, func(r libdns.Record) bool { return r.TTL == AutoTTL }) {
+			Logger(ctx).Debug("keeping automatic ttl", "zone", zone, "name", name, "type", recordType)
+			for j := range want {
+				want[j].TTL = AutoTTL
+			}
+		}
+		// Existing records have IDs, and are compared by their own
+		// proxying, while the wanted ones are compared by the domain's.
+		var proxied func(libdns.Record) bool
+		if u.SyncProxied && proxiedIDs != nil && proxiable(recordType) {
+			wantProxied := i >= 0 && domains[i].Proxied
+			proxied = func(r libdns.Record) bool {
+				if r.ID == "" {
+					return wantProxied
+				}
+				return proxiedIDs[r.ID]
+			}
+		}
+		// Cloudflare reports a TTL of auto for proxied records, whatever
+		// TTL they were written with.
+		syncTTL := u.SyncTTL
+		if syncTTL && proxiable(recordType) && slices.ContainsFunc(have, func(r libdns.Record) bool { return proxiedIDs[r.ID] }) {
+			Logger(ctx).Debug("not comparing the ttl of proxied records", "zone", zone, "name", name, "type", recordType)
+			syncTTL = false
+		}
+		if u.Force {
+			for _, rec := range want {
+				if i := slices.IndexFunc(have, func(r libdns.Record) bool { return sameRecord(r, rec, syncTTL, proxied) }); i >= 0 {
+					rec.ID = have[i].ID
+					Logger(ctx).Info("will force write of unchanged record", "zone", zone, "name", name, "type", recordType, "value", rec.Value, "ttl", rec.TTL)
+					zc.set = append(zc.set, rec)
+					zc.forced = append(zc.forced, Change{Domain: libdns.AbsoluteName(name, zone), Type: recordType, Old: rec.Value, New: rec.Value})
+				}
+			}
+		}
+		missing := slices.DeleteFunc(slices.Clone(want), func(r libdns.Record) bool { return containsRecord(have, r, syncTTL, proxied) })
+		unchanged := slices.DeleteFunc(slices.Clone(want), func(r libdns.Record) bool { return !containsRecord(have, r, syncTTL, proxied) })
+		extra := slices.DeleteFunc(have, func(r libdns.Record) bool { return containsRecord(want, r, syncTTL, proxied) })
+		if u.Append && len(extra) > 0 {
+			Logger(ctx).Debug("appending, keeping other records", "zone", zone, "name", name, "type", recordType, "records", len(extra))
+			extra = nil
+		}
+		sum.unchanged += len(unchanged)
+		if !u.Force {
+			for _, rec := range unchanged {
+				u.report(ctx, zone, rec, rec.Value, StatusUnchanged)
+			}
+		}
+		if len(missing) == 0 && len(extra) == 0 && !u.Force {
+			for _, rec := range want {
+				Logger(ctx).Info("record unchanged", "zone", zone, "name", name, "type", recordType, "value", rec.Value)
+			}
+			continue
+		}
+
+		fqdn := libdns.AbsoluteName(name, zone)
+		for i, rec := range missing {
+			c := Change{Domain: fqdn, Type: recordType, New: rec.Value}
+			if i < len(extra) {
+				c.Old = extra[i].Value
+			}
+			if err := u.beforeChange(ctx, c); err != nil {
+				zc.rejected = append(zc.rejected, err)
+				continue
+			}
+			if i < len(extra) {
+				// Reuse a record we no longer want, which keeps its
+				// other settings.
+				rec.ID, c.Old = extra[i].ID, extra[i].Value
+				Logger(ctx).Info("will set record", "zone", zone, "name", name, "type", recordType, "old", c.Old, "value", rec.Value, "ttl", rec.TTL)
+				zc.set = append(zc.set, rec)
+			} else {
+				Logger(ctx).Info("will create record", "zone", zone, "name", name, "type", recordType, "value", rec.Value, "ttl", rec.TTL)
+				zc.add = append(zc.add, rec)
+			}
+			zc.changes = append(zc.changes, c)
+		}
+		for _, rec := range extra[min(len(missing), len(extra)):] {
+			c := Change{Domain: fqdn, Type: recordType, Old: rec.Value}
+			if err := u.beforeChange(ctx, c); err != nil {
+				zc.rejected = append(zc.rejected, err)
+				continue
+			}
+			Logger(ctx).Info("will delete record", "zone", zone, "name", name, "type", recordType, "value", rec.Value)
+			zc.del = append(zc.del, rec)
+			zc.changes = append(zc.changes, c)
+		}
+	}
+
+	var errs []error
+	for _, recordType := range types {
+		zc := byType[recordType]
+		needsWrite := len(zc.changes) > 0 || len(zc.forced) > 0
+		if needsWrite && u.DryRun {
+			Logger(ctx).Info("dry run, skipping update", "zone", zone, "type", recordType, "records", len(zc.changes), "forced", len(zc.forced))
+			for _, c := range slices.Concat(zc.changes, zc.forced) {
+				u.reportChange(ctx, c, StatusDryRun)
+			}
+		} else if needsWrite {
+			if err := u.writeChanges(ctx, zone, domains, zc); err != nil {
+				Logger(ctx).Error("could not update records", "zone", zone, "type", recordType, "err", err)
+				errs = append(errs, fmt.Errorf("%v records: %w", recordType, err))
+				for _, c := range slices.Concat(zc.changes, zc.forced) {
+					u.reportChange(ctx, c, StatusFailed)
+				}
+				continue
+			}
+		}
+		sum.updated += len(zc.set) - len(zc.forced)
+		sum.created += len(zc.add)
+		sum.deleted += len(zc.del)
+		if len(zc.rejected) > 0 {
+			errs = append(errs, fmt.Errorf("%v records: %w", recordType, errors.Join(zc.rejected...)))
+			continue
+		}
+		ok = append(ok, recordType)
+	}
+	if len(ok) == len(types) && sum.updated+sum.created+sum.deleted == 0 && !u.Force {
+		Logger(ctx).Info("no change, skipping update", "zone", zone)
+	}
+	return sum, ok, errors.Join(errs...)
+}
+
+// getRecords reads the existing records of zone, retrying with ReadRetry
+// within ReadTimeout.
+func (u *Updater) getRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	readCtx := ctx
+	if u.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, u.ReadTimeout)
+		defer cancel()
+	}
+	var existing []libdns.Record
+	err := u.ReadRetry.do(readCtx, "get records", func() error {
+		var err error
+		existing, err = u.Provider.GetRecords(readCtx, zone)
+		return err
+	})
+	if err != nil && readCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, fmt.Errorf("read timed out after %v: %w", u.ReadTimeout, err)
+	}
+	return existing, err
+}
+
+// writeUnread sets records, which are those of domains in zone, without
+// knowing the existing records. The provider matches each record to an
+// existing one by name and type. The old values are unknown, so the records
+// are reported as forced rather than as changes, and BeforeChange isn't
+// called.
+func (u *Updater) writeUnread(ctx context.Context, zone string, domains []Domain, records []libdns.Record) (sum summary, ok []string, err error) {
+	var types []string
+	byType := make(map[string]*zoneChanges)
+	for _, rec := range records {
+		zc, found := byType[rec.Type]
+		if !found {
+			zc = &zoneChanges{}
+			byType[rec.Type] = zc
+			types = append(types, rec.Type)
+		}
+		zc.set = append(zc.set, rec)
+		zc.forced = append(zc.forced, Change{Domain: libdns.AbsoluteName(rec.Name, zone), Type: rec.Type, New: rec.Value})
+	}
+	var errs []error
+	for _, recordType := range types {
+		zc := byType[recordType]
+		if u.DryRun {
+			Logger(ctx).Info("dry run, skipping update", "zone", zone, "type", recordType, "records", len(zc.set))
+			for _, c := range zc.forced {
+				u.reportChange(ctx, c, StatusDryRun)
+			}
+		} else if err := u.writeChanges(ctx, zone, domains, zc); err != nil {
+			Logger(ctx).Error("could not update records", "zone", zone, "type", recordType, "err", err)
+			errs = append(errs, fmt.Errorf("%v records: %w", recordType, err))
+			for _, c := range zc.forced {
+				u.reportChange(ctx, c, StatusFailed)
+			}
+			continue
+		}
+		ok = append(ok, recordType)
+		sum.updated += len(zc.set)
+	}
+	return sum, ok, errors.Join(errs...)
+}
+
+// beforeChange calls BeforeChange for c, unless it's unset or this is a dry
+// run.
+func (u *Updater) beforeChange(ctx context.Context, c Change) error {
+	if u.BeforeChange == nil || u.DryRun {
+		return nil
+	}
+	if err := u.BeforeChange(ctx, c); err != nil {
+		Logger(ctx).Error("change rejected, leaving record as it is", "domain", c.Domain, "type", c.Type, "old", c.Old, "new", c.New, "err", err)
+		u.reportChange(ctx, c, StatusRejected)
+		return fmt.Errorf("change of %v rejected: %w", c.Domain, err)
+	}
+	return nil
+}
+
+// writeChanges makes the writes of zc to zone, whose records are those of
+// domains, and reports each changed record.
+func (u *Updater) writeChanges(ctx context.Context, zone string, domains []Domain, zc *zoneChanges) error {
+	var written []libdns.Record
+	if len(zc.set) > 0 {
+		err := u.Retry.do(ctx, "set records", func() error {
+			result, err := u.Provider.SetRecords(ctx, zone, zc.set)
+			Logger(ctx).Debug("set records", "zone", zone, "records", result, "err", err)
+			if err == nil {
+				written = append(written, result...)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not update records: %w", err)
+		}
+	}
+	if len(zc.add) > 0 {
+		err := u.Retry.do(ctx, "create records", func() error {
+			result, err := u.Provider.AppendRecords(ctx, zone, zc.add)
+			Logger(ctx).Debug("appended records", "zone", zone, "records", result, "err", err)
+			if err == nil {
+				written = append(written, result...)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not create records: %w", err)
+		}
+	}
+	if len(zc.del) > 0 {
+		err := u.Retry.do(ctx, "delete records", func() error {
+			_, err := u.Provider.DeleteRecords(ctx, zone, zc.del)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not delete records: %w", err)
+		}
+	}
+	comment := strings.ReplaceAll(u.Comment, "{time}", time.Now().UTC().Format(time.RFC3339))
+	for _, rec := range written {
+		fields := make(map[string]any)
+		i := slices.IndexFunc(domains, func(d Domain) bool { return sameName(d.Subdomain, rec.Name) })
+		if i >= 0 && proxiable(rec.Type) && (domains[i].Proxied || u.SyncProxied) {
+			fields["proxied"] = domains[i].Proxied
+		}
+		if comment != "" && u.Cloudflare != nil {
+			fields["comment"] = comment
+		}
+		// The provider doesn't return the IDs of some types, like SRV.
+		if len(fields) == 0 || rec.ID == "" {
+			continue
+		}
+		err := u.Retry.do(ctx, "patch record", func() error {
+			return u.Cloudflare.patchRecord(ctx, zone, rec.ID, fields)
+		})
+		if err != nil {
+			return fmt.Errorf("could not set the proxying or comment of %v %v: %w", rec.Type, rec.Name, err)
+		}
+	}
+	Logger(ctx).Debug("wrote records", "zone", zone, "records", written)
+	if len(zc.forced) > 0 {
+		Logger(ctx).Info("forced write of records", "zone", zone, "records", len(zc.forced))
+	}
+	for _, c := range zc.forced {
+		u.reportChange(ctx, c, StatusForced)
+	}
+	for _, c := range zc.changes {
+		switch {
+		case c.Old == "":
+			Logger(ctx).Info("created record", "domain", c.Domain, "type", c.Type, "value", c.New)
+			u.reportChange(ctx, c, StatusCreated)
+		case c.New == "":
+			Logger(ctx).Info("deleted record", "domain", c.Domain, "type", c.Type, "value", c.Old)
+			u.reportChange(ctx, c, StatusDeleted)
+		default:
+			Logger(ctx).Info("updated record", "domain", c.Domain, "type", c.Type, "old", c.Old, "new", c.New)
+			u.reportChange(ctx, c, StatusUpdated)
+		}
+		if u.OnChange != nil {
+			u.OnChange(ctx, c)
+		}
+	}
+	return nil
+}
+
+// checkConflicts returns an error if any of records can't coexist with the
+// existing records at the same name, since a CNAME must be the only record at
+// its name.
+func checkConflicts(zone string, existing, records []libdns.Record) error {
+	var errs []error
+	for _, want := range groupRecords(records) {
+		name, recordType := want[0].Name, want[0].Type
+		for _, r := range existing {
+			if !sameName(r.Name, name) || r.Type == recordType {
+				continue
+			}
+			if r.Type == "CNAME" || recordType == "CNAME" {
+				errs = append(errs, fmt.Errorf("name %v already has a %v record; cannot create %v", libdns.AbsoluteName(name, zone), r.Type, recordType))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// groupRecords groups records with the same name and type, keeping them in
+// the order they first appear.
+func groupRecords(records []libdns.Record) [][]libdns.Record {
+	var groups [][]libdns.Record
+	for _, rec := range records {
+		i := slices.IndexFunc(groups, func(g []libdns.Record) bool {
+			return g[0].Type == rec.Type && sameName(g[0].Name, rec.Name)
+		})
+		if i < 0 {
+			groups = append(groups, []libdns.Record{rec})
+			continue
+		}
+		groups[i] = append(groups[i], rec)
+	}
+	return groups
+}
+
+// sameName reports whether a and b are the same relative record name. The
+// zone apex can be written as either "@" or "".
+func sameName(a, b string) bool {
+	if a == "@" {
+		a = ""
+	}
+	if b == "@" {
+		b = ""
+	}
+	return a == b
+}
+
+// Delete removes the records of the configured types from every domain.
+func (u *Updater) Delete(ctx context.Context) error {
+	var errs []error
+	zones, byZone := groupByZone(u.Domains)
+	for _, zone := range zones {
+		if err := u.forZone(byZone[zone]).deleteZone(ctx, zone, byZone[zone]); err != nil {
+			Logger(ctx).Error("could not delete from zone", "zone", zone, "err", err)
+			errs = append(errs, zoneError(zone, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteZone removes the records of the configured types for domains, which
+// must all be in zone.
+func (u *Updater) deleteZone(ctx context.Context, zone string, domains []Domain) error {
+	existing, err := u.getRecords(ctx, zone)
+	if err != nil {
+		return fmt.Errorf("could not get existing records: %w", err)
+	}
+	var stale []libdns.Record
+	for _, rec := range existing {
+		if !slices.ContainsFunc(domains, func(d Domain) bool {
+			return sameName(recordName(d, rec.Type, u.SRV), rec.Name) && slices.Contains(d.RecordTypes, rec.Type)
+		}) {
+			continue
+		}
+		Logger(ctx).Info("will delete record", "zone", zone, "name", rec.Name, "type", rec.Type, "value", rec.Value)
+		stale = append(stale, rec)
+	}
+	if len(stale) == 0 {
+		Logger(ctx).Info("no records to delete", "zone", zone)
+		return nil
+	}
+	if u.DryRun {
+		Logger(ctx).Info("dry run, skipping delete", "zone", zone, "records", len(stale))
+		return nil
+	}
+
+	var result []libdns.Record
+	err = u.Retry.do(ctx, "delete records", func() error {
+		var err error
+		result, err = u.Provider.DeleteRecords(ctx, zone, stale)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not delete records: %w", err)
+	}
+	Logger(ctx).Info("deleted records", "zone", zone, "records", result)
+	return nil
+}
+
+// containsRecord reports whether recs already has a record equal to rec, as
+// compared by sameRecord.
+func containsRecord(recs []libdns.Record, rec libdns.Record, syncTTL bool, proxied func(libdns.Record) bool) bool {
+	return slices.ContainsFunc(recs, func(r libdns.Record) bool { return sameRecord(r, rec, syncTTL, proxied) })
+}
+
+// proxiable reports whether records of recordType can be proxied, which only
+// address and CNAME records can.
+func proxiable(recordType string) bool {
+	return IsAddressType(recordType) || recordType == "CNAME"
+}
+
+// sameRecord reports whether a and b have the same type, name, value,
+// priority and weight, and also the same TTL if syncTTL is set. If proxied is
+// non-nil, they must also have the same proxying, as it reports.
+func sameRecord(a, b libdns.Record, syncTTL bool, proxied func(libdns.Record) bool) bool {
+	if a.Type != b.Type || !sameName(a.Name, b.Name) || a.Value != b.Value || a.Priority != b.Priority || a.Weight != b.Weight {
+		return false
+	}
+	if proxied != nil && proxied(a) != proxied(b) {
+		return false
+	}
+	return !syncTTL || a.TTL == b.TTL
+}
@@ -0,0 +1,345 @@
+package ddns
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// fakeProvider is a Provider that keeps the records of one zone in memory.
+type fakeProvider struct {
+	mu      sync.Mutex
+	records []libdns.Record
+	nextID  int
+	// writes counts the records that were set, appended or deleted.
+	writes int
+}
+
+func (p *fakeProvider) GetRecords(_ context.Context, _ string) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.records), nil
+}
+
+func (p *fakeProvider) AppendRecords(_ context.Context, _ string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var created []libdns.Record
+	for _, rec := range recs {
+		p.nextID++
+		rec.ID = fmt.Sprint("new", p.nextID)
+		p.records = append(p.records, rec)
+		created = append(created, rec)
+		p.writes++
+	}
+	return created, nil
+}
+
+func (p *fakeProvider) SetRecords(_ context.Context, _ string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rec := range recs {
+		i := slices.IndexFunc(p.records, func(r libdns.Record) bool {
+			if rec.ID != "" {
+				return r.ID == rec.ID
+			}
+			return r.Type == rec.Type && sameName(r.Name, rec.Name)
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("no record to set for %+v", rec)
+		}
+		rec.ID = p.records[i].ID
+		p.records[i] = rec
+		p.writes++
+	}
+	return recs, nil
+}
+
+func (p *fakeProvider) DeleteRecords(_ context.Context, _ string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rec := range recs {
+		i := slices.IndexFunc(p.records, func(r libdns.Record) bool { return r.ID == rec.ID })
+		if i < 0 {
+			return nil, fmt.Errorf("no record to delete for %+v", rec)
+		}
+		p.records = slices.Delete(p.records, i, i+1)
+		p.writes++
+	}
+	return recs, nil
+}
+
+// aRecord returns an A record of name with value and ID id.
+func aRecord(id, name, value string) libdns.Record {
+	return libdns.Record{ID: id, Type: "A", Name: name, Value: value, TTL: 5 * time.Minute}
+}
+
+func TestUpdateZone(t *testing.T) {
+	home := Domain{Zone: "example.com", Subdomain: "home", TTL: 5 * time.Minute, RecordTypes: []string{"A"}}
+	for _, tc := range []struct {
+		name     string
+		existing []libdns.Record
+		want     []libdns.Record
+		wantSum  summary
+		// wantRecords are the records of the zone after the update.
+		wantRecords []libdns.Record
+	}{
+		{
+			name:        "create",
+			want:        []libdns.Record{aRecord("", "home", "192.0.2.1")},
+			wantSum:     summary{created: 1},
+			wantRecords: []libdns.Record{aRecord("new1", "home", "192.0.2.1")},
+		},
+		{
+			name:        "unchanged",
+			existing:    []libdns.Record{aRecord("a1", "home", "192.0.2.1")},
+			want:        []libdns.Record{aRecord("", "home", "192.0.2.1")},
+			wantSum:     summary{unchanged: 1},
+			wantRecords: []libdns.Record{aRecord("a1", "home", "192.0.2.1")},
+		},
+		{
+			name:        "update in place",
+			existing:    []libdns.Record{aRecord("a1", "home", "192.0.2.9")},
+			want:        []libdns.Record{aRecord("", "home", "192.0.2.1")},
+			wantSum:     summary{updated: 1},
+			wantRecords: []libdns.Record{aRecord("a1", "home", "192.0.2.1")},
+		},
+		{
+			name:        "delete extra",
+			existing:    []libdns.Record{aRecord("a1", "home", "192.0.2.1"), aRecord("a2", "home", "192.0.2.2")},
+			want:        []libdns.Record{aRecord("", "home", "192.0.2.1")},
+			wantSum:     summary{unchanged: 1, deleted: 1},
+			wantRecords: []libdns.Record{aRecord("a1", "home", "192.0.2.1")},
+		},
+		{
+			name:        "add a value",
+			existing:    []libdns.Record{aRecord("a1", "home", "192.0.2.1")},
+			want:        []libdns.Record{aRecord("", "home", "192.0.2.1"), aRecord("", "home", "192.0.2.2")},
+			wantSum:     summary{unchanged: 1, created: 1},
+			wantRecords: []libdns.Record{aRecord("a1", "home", "192.0.2.1"), aRecord("new1", "home", "192.0.2.2")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &fakeProvider{records: slices.Clone(tc.existing)}
+			u := &Updater{Provider: p}
+
+			sum, ok, err := u.updateZone(context.Background(), "example.com", []Domain{home}, tc.want)
+			if err != nil {
+				t.Fatalf("updateZone() failed: %v", err)
+			}
+			if sum != tc.wantSum {
+				t.Errorf("updateZone() summary = %+v, want %+v", sum, tc.wantSum)
+			}
+			if !slices.Equal(ok, []string{"A"}) {
+				t.Errorf("updateZone() up to date types = %v, want [A]", ok)
+			}
+			if !slices.Equal(p.records, tc.wantRecords) {
+				t.Errorf("records after updateZone() = %+v, want %+v", p.records, tc.wantRecords)
+			}
+		})
+	}
+}
+
+func TestBuildRecords(t *testing.T) {
+	u := &Updater{SRV: &SRV{Service: "minecraft", Proto: "tcp", Port: 25565, Priority: 1, Weight: 2}}
+	d := Domain{Zone: "example.com", Subdomain: "home", TTL: time.Hour, RecordTypes: []string{"A", "AAAA", "TXT", "SRV"}}
+	values := map[string][]string{
+		"A":   {"192.0.2.1", "192.0.2.2"},
+		"TXT": {"hello"},
+	}
+
+	// AAAA wasn't detected, so it's left out.
+	got := u.buildRecords(d, []string{"A", "TXT", "SRV"}, values)
+	want := []libdns.Record{
+		{Type: "A", Name: "home", Value: "192.0.2.1", TTL: time.Hour},
+		{Type: "A", Name: "home", Value: "192.0.2.2", TTL: time.Hour},
+		{Type: "TXT", Name: "home", Value: "hello", TTL: time.Hour},
+		{Type: "SRV", Name: "_minecraft._tcp.home", Value: "25565 home.example.com", TTL: time.Hour, Priority: 1, Weight: 2},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("buildRecords() = %+v, want %+v", got, want)
+	}
+}
+
+func TestUpdateLeavesOtherRecords(t *testing.T) {
+	others := []libdns.Record{
+		{ID: "mx1", Type: "MX", Name: "@", Value: "mail.example.com", TTL: time.Hour, Priority: 10},
+		aRecord("a2", "www", "198.51.100.1"),
+		aRecord("a3", "home.lab", "198.51.100.2"),
+		{ID: "aaaa1", Type: "AAAA", Name: "home", Value: "2001:db8::1", TTL: time.Hour},
+		{ID: "txt1", Type: "TXT", Name: "home", Value: "v=spf1 -all", TTL: time.Hour},
+	}
+	p := &fakeProvider{records: append(slices.Clone(others), aRecord("a1", "home", "192.0.2.9"))}
+	u := &Updater{
+		Provider:    p,
+		Source:      StaticSource{"A": {net.IPv4(192, 0, 2, 1)}},
+		Domains:     []Domain{{Zone: "example.com", Subdomain: "home", TTL: 5 * time.Minute, RecordTypes: []string{"A"}}},
+		RecordTypes: []string{"A"},
+		// The documentation ranges aren't public.
+		AllowPrivate: true,
+	}
+
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	want := append(slices.Clone(others), aRecord("a1", "home", "192.0.2.1"))
+	if !slices.Equal(p.records, want) {
+		t.Errorf("records after Update() = %+v, want %+v", p.records, want)
+	}
+	if p.writes != 1 {
+		t.Errorf("Update() wrote %d records, want 1", p.writes)
+	}
+}
+
+func TestUpdateLargeZone(t *testing.T) {
+	// The record to update is past the first page of 100 records, so an
+	// update that only read the first page would create a duplicate.
+	var records []cfRecord
+	for i := range 150 {
+		records = append(records, cfRecord{ID: fmt.Sprint("other", i), Type: "A", Name: fmt.Sprintf("host%d.example.com", i), Content: "198.51.100.1", TTL: 300})
+	}
+	records = append(records, cfRecord{ID: "home1", Type: "A", Name: "home.example.com", Content: "192.0.2.9", TTL: 300})
+	f, c := newFakeCloudflare(t, slices.Clone(records))
+	u := &Updater{
+		Provider:     c,
+		Cloudflare:   c,
+		Source:       StaticSource{"A": {net.IPv4(192, 0, 2, 1)}},
+		Domains:      []Domain{{Zone: "example.com", Subdomain: "home", TTL: 5 * time.Minute, RecordTypes: []string{"A"}}},
+		RecordTypes:  []string{"A"},
+		AllowPrivate: true,
+	}
+
+	for range 2 {
+		if err := u.Update(context.Background()); err != nil {
+			t.Fatalf("Update() failed: %v", err)
+		}
+	}
+	records[len(records)-1].Content = "192.0.2.1"
+	if len(f.records) != len(records) {
+		t.Fatalf("zone has %d records after Update(), want %d", len(f.records), len(records))
+	}
+	for i := range records {
+		if fmt.Sprint(f.records[i]) != fmt.Sprint(records[i]) {
+			t.Errorf("record %d after Update() = %+v, want %+v", i, f.records[i], records[i])
+		}
+	}
+}
+
+func TestUpdateProxied(t *testing.T) {
+	for _, tc := range []struct {
+		name                    string
+		syncProxied             bool
+		wantProxied, hasProxied bool
+		value                   string
+		wantStatus              string
+		// proxiedAfter is the proxying of the record after the update.
+		proxiedAfter bool
+	}{
+		{name: "proxied and proxied", syncProxied: true, wantProxied: true, hasProxied: true, wantStatus: StatusUnchanged, proxiedAfter: true},
+		{name: "proxied but not proxied", syncProxied: true, wantProxied: true, wantStatus: StatusUpdated, proxiedAfter: true},
+		{name: "not proxied but proxied", syncProxied: true, hasProxied: true, wantStatus: StatusUpdated},
+		{name: "not proxied and not proxied", syncProxied: true, wantStatus: StatusUnchanged},
+		// Without -sync-proxied or -proxied, the proxying set elsewhere is
+		// kept, even when the value changes.
+		{name: "kept when unchanged", hasProxied: true, wantStatus: StatusUnchanged, proxiedAfter: true},
+		{name: "kept when updated", hasProxied: true, value: "192.0.2.9", wantStatus: StatusUpdated, proxiedAfter: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, c := newFakeCloudflare(t, []cfRecord{{ID: "a1", Type: "A", Name: "home.example.com", Content: cmp.Or(tc.value, "192.0.2.1"), TTL: 300, Proxied: tc.hasProxied}})
+			var statuses []string
+			u := &Updater{
+				Provider:     c,
+				Cloudflare:   c,
+				Source:       StaticSource{"A": {net.IPv4(192, 0, 2, 1)}},
+				Domains:      []Domain{{Zone: "example.com", Subdomain: "home", TTL: 5 * time.Minute, Proxied: tc.wantProxied, RecordTypes: []string{"A"}}},
+				RecordTypes:  []string{"A"},
+				AllowPrivate: true,
+				SyncProxied:  tc.syncProxied,
+				OnResult:     func(_ context.Context, r Result) { statuses = append(statuses, r.Status) },
+			}
+
+			if err := u.Update(context.Background()); err != nil {
+				t.Fatalf("Update() failed: %v", err)
+			}
+			if !slices.Equal(statuses, []string{tc.wantStatus}) {
+				t.Errorf("Update() results = %v, want [%s]", statuses, tc.wantStatus)
+			}
+			if len(f.records) != 1 || f.records[0].Content != "192.0.2.1" || f.records[0].Proxied != tc.proxiedAfter {
+				t.Errorf("records after Update() = %+v, want 192.0.2.1 with proxied %v", f.records, tc.proxiedAfter)
+			}
+		})
+	}
+}
+
+func TestUpdateApexSRV(t *testing.T) {
+	f, c := newFakeCloudflare(t, nil)
+	var statuses []string
+	u := &Updater{
+		Provider:     c,
+		Cloudflare:   c,
+		Source:       StaticSource{"A": {net.IPv4(192, 0, 2, 1)}},
+		Domains:      []Domain{{Zone: "example.com", Subdomain: "@", TTL: 5 * time.Minute, RecordTypes: []string{"SRV"}}},
+		RecordTypes:  []string{"A", "SRV"},
+		SRV:          &SRV{Service: "minecraft", Proto: "tcp", Port: 25565, Priority: 1, Weight: 2},
+		AllowPrivate: true,
+		OnResult:     func(_ context.Context, r Result) { statuses = append(statuses, r.Status) },
+	}
+
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	wantData := cfSRVData{Priority: 1, Weight: 2, Port: 25565, Target: "example.com"}
+	if len(f.records) != 1 || f.records[0].Name != "_minecraft._tcp.example.com" || f.records[0].Data == nil || *f.records[0].Data != wantData {
+		t.Fatalf("records after Update() = %+v, want an SRV record named _minecraft._tcp.example.com with %+v", f.records, wantData)
+	}
+
+	// The record reads back as the one that was written.
+	statuses = nil
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("second Update() failed: %v", err)
+	}
+	if !slices.Equal(statuses, []string{StatusUnchanged}) {
+		t.Errorf("second Update() results = %v, want [%s]", statuses, StatusUnchanged)
+	}
+}
+
+func TestUpdateSyncTTLProxied(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		proxied    bool
+		wantStatus string
+	}{
+		// Cloudflare reports TTL 1, which is auto, for proxied records.
+		{"proxied", true, StatusUnchanged},
+		{"not proxied", false, StatusUpdated},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, c := newFakeCloudflare(t, []cfRecord{{ID: "a1", Type: "A", Name: "home.example.com", Content: "192.0.2.1", TTL: 1, Proxied: tc.proxied}})
+			var statuses []string
+			u := &Updater{
+				Provider:     c,
+				Cloudflare:   c,
+				Source:       StaticSource{"A": {net.IPv4(192, 0, 2, 1)}},
+				Domains:      []Domain{{Zone: "example.com", Subdomain: "home", TTL: 5 * time.Minute, Proxied: tc.proxied, RecordTypes: []string{"A"}}},
+				RecordTypes:  []string{"A"},
+				AllowPrivate: true,
+				SyncTTL:      true,
+				OnResult:     func(_ context.Context, r Result) { statuses = append(statuses, r.Status) },
+			}
+
+			if err := u.Update(context.Background()); err != nil {
+				t.Fatalf("Update() failed: %v", err)
+			}
+			if !slices.Equal(statuses, []string{tc.wantStatus}) {
+				t.Errorf("Update() results = %v, want [%s]", statuses, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+)
+
+// WithWeights makes the sources of a chain from ParseIPSources be tried in a
+// random order on each detection instead of in the given one, to spread the
+// detections over them. The first source is picked with a chance
+// proportional to its weight, then the next one among those left, and so on,
+// so that the others are still fallen back to if it fails. Sources of weight
+// zero are only tried, in order, after all the others. weights must have one
+// weight for each source of the chain. An empty weights returns source as it
+// is.
+func WithWeights(source IPSource, weights []int) (IPSource, error) {
+	if len(weights) == 0 {
+		return source, nil
+	}
+	chain, ok := source.(sourceChain)
+	if !ok {
+		chain = sourceChain{source}
+	}
+	if len(weights) != len(chain) {
+		return nil, fmt.Errorf("got %d ip source weights for %d ip sources", len(weights), len(chain))
+	}
+	if len(chain) == 1 {
+		return source, nil
+	}
+	return weightedSource{sources: chain, weights: weights}, nil
+}
+
+// weightedSource is a source made by WithWeights.
+type weightedSource struct {
+	sources []IPSource
+	weights []int
+}
+
+func (s weightedSource) DetectIP(ctx context.Context, recordType string) (net.IP, error) {
+	return s.order().DetectIP(ctx, recordType)
+}
+
+// order returns the sources in the order to try them in for one detection.
+func (s weightedSource) order() sourceChain {
+	sources, weights := slices.Clone(s.sources), slices.Clone(s.weights)
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	order := make(sourceChain, 0, len(sources))
+	for total > 0 {
+		n := rand.IntN(total)
+		i := 0
+		for n >= weights[i] {
+			n -= weights[i]
+			i++
+		}
+		order = append(order, sources[i])
+		total -= weights[i]
+		sources, weights = slices.Delete(sources, i, i+1), slices.Delete(weights, i, i+1)
+	}
+	return append(order, sources...)
+}
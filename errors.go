@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// Exit codes, so that calling scripts can tell what kind of failure
+// happened.
+const (
+	exitFailure = 1 // anything not covered below
+	exitConfig  = 2 // invalid flags or config
+	exitDetect  = 3 // no address could be detected
+	exitAPI     = 4 // the DNS provider failed
+	exitPartial = 5 // some records were published but others failed
+	exitAuth    = 6 // the API token was rejected or can't access a zone
+)
+
+// exitError is an error that causes the process to exit with code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func configError(err error) error { return &exitError{code: exitConfig, err: err} }
+func detectError(err error) error { return &exitError{code: exitDetect, err: err} }
+
+// kindCodes maps the kinds of errors returned by the updater to exit codes.
+var kindCodes = map[ddns.Kind]int{
+	ddns.KindDetect:  exitDetect,
+	ddns.KindAPI:     exitAPI,
+	ddns.KindAuth:    exitAuth,
+	ddns.KindPartial: exitPartial,
+}
+
+// exitCode returns the exit code for err. If err joins several errors, the
+// first one with a code wins.
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	var de *ddns.Error
+	if errors.As(err, &de) {
+		return kindCodes[de.Kind]
+	}
+	return exitFailure
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cycleStatus tracks the outcome of recent update cycles.
+type cycleStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   time.Time
+	lastErr     string
+	// addrs are the addresses detected by the last update, and next is
+	// when the next one is due.
+	addrs map[string][]net.IP
+	next  time.Time
+}
+
+// status is the status of the update cycles run by this process.
+var status cycleStatus
+
+// record notes the result of an update cycle that finished now.
+func (s *cycleStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.lastError = time.Now()
+		s.lastErr = err.Error()
+		return
+	}
+	s.lastSuccess = time.Now()
+}
+
+// detected notes the addresses detected by an update.
+func (s *cycleStatus) detected(addrs map[string][]net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs = addrs
+}
+
+// scheduled notes when the next update is due.
+func (s *cycleStatus) scheduled(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = next
+}
+
+// healthHandler reports whether an update succeeded within the last
+// staleness, with 200 if one did and 503 otherwise.
+func healthHandler(staleness time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status.mu.Lock()
+		resp := struct {
+			Healthy     bool       `json:"healthy"`
+			LastSuccess *time.Time `json:"last_success,omitempty"`
+			LastError   *time.Time `json:"last_error,omitempty"`
+			Error       string     `json:"error,omitempty"`
+		}{
+			Healthy: !status.lastSuccess.IsZero() && time.Since(status.lastSuccess) <= staleness,
+			Error:   status.lastErr,
+		}
+		if !status.lastSuccess.IsZero() {
+			t := status.lastSuccess
+			resp.LastSuccess = &t
+		}
+		if !status.lastError.IsZero() {
+			t := status.lastError
+			resp.LastError = &t
+		}
+		status.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !resp.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
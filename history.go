@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// addrChange is a change of the detected addresses of a record type.
+type addrChange struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Old  []net.IP  `json:"old"`
+	New  []net.IP  `json:"new"`
+}
+
+// changeHistory keeps the most recent address changes, up to size of them.
+type changeHistory struct {
+	mu      sync.Mutex
+	size    int
+	changes []addrChange
+}
+
+// history is the history of the address changes seen by this process.
+var history = changeHistory{size: 100}
+
+// add notes that the addresses of recordType changed from old to new now,
+// dropping the oldest change if the history is full.
+func (h *changeHistory) add(recordType string, old, new []net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size <= 0 {
+		return
+	}
+	if len(h.changes) >= h.size {
+		h.changes = h.changes[len(h.changes)-h.size+1:]
+	}
+	h.changes = append(h.changes, addrChange{Time: time.Now(), Type: recordType, Old: old, New: new})
+}
+
+// historyHandler serves the recent address changes as JSON, oldest first.
+func historyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		history.mu.Lock()
+		changes := append([]addrChange{}, history.changes...)
+		history.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
+	})
+}
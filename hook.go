@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// runHook runs command with the shell, describing c in its environment. The
+// output of the command goes to stderr, along with the logs.
+func runHook(ctx context.Context, command string, c ddns.Change) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"DYNCF_DOMAIN="+c.Domain,
+		"DYNCF_TYPE="+c.Type,
+		"DYNCF_OLD="+c.Old,
+		"DYNCF_NEW="+c.New,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %q failed: %w", command, err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// lockFile takes a lock of the file at path, which needs flock and so only
+// works on Unix.
+func lockFile(context.Context, string, time.Duration) (*os.File, error) {
+	return nil, errors.New("lock files are only supported on Unix")
+}
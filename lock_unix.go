@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// lockPoll is how often a held lock file is tried again while waiting.
+const lockPoll = 100 * time.Millisecond
+
+// lockFile takes an exclusive lock of the file at path, creating it if
+// needed, and writes our PID to it. If another process holds the lock, it
+// fails at once if wait is zero, and otherwise tries again until wait has
+// passed or ctx is done. The lock is held until the returned file is closed
+// or the process exits.
+func lockFile(ctx context.Context, path string, wait time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %w", err)
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("could not lock %v: %w", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("another instance holds the lock of %v", path)
+		}
+		if !sleep(ctx, min(lockPoll, time.Until(deadline))) {
+			f.Close()
+			return nil, ctx.Err()
+		}
+	}
+	// The PID is only informational, so failing to write it is fine.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
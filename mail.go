@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// smtpTimeout bounds sending one summary email.
+const smtpTimeout = 30 * time.Second
+
+// mailer emails a summary of each update run. A nil *mailer does nothing.
+type mailer struct {
+	// addr is the host:port of the SMTP server.
+	addr     string
+	from     string
+	to       []string
+	user     string
+	password string
+	// always sends a summary after every run, not only after one that
+	// changed a record or failed.
+	always bool
+
+	mu      sync.Mutex
+	results []ddns.Result
+}
+
+// newMailer returns the mailer configured by cfg, or nil if there is none.
+func newMailer(cfg *Config) (*mailer, error) {
+	if cfg.SMTPServer == "" {
+		return nil, nil
+	}
+	m := &mailer{addr: cfg.SMTPServer, from: cfg.SMTPFrom, to: cfg.SMTPTo, user: cfg.SMTPUser, always: cfg.SMTPAlways}
+	if m.user == "" {
+		return m, nil
+	}
+	if cfg.SMTPPasswordFile == "" {
+		m.password = os.Getenv("SMTP_PASSWORD")
+		if m.password == "" {
+			return nil, fmt.Errorf("smtp user %v needs a password in smtp password file or the SMTP_PASSWORD env var", m.user)
+		}
+		return m, nil
+	}
+	b, err := os.ReadFile(cfg.SMTPPasswordFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read smtp password: %w", err)
+	}
+	m.password = strings.TrimRight(string(b), "\r\n")
+	return m, nil
+}
+
+// record remembers r for the summary of the current run.
+func (m *mailer) record(_ context.Context, r ddns.Result) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results = append(m.results, r)
+}
+
+// wrap returns update, followed by sending the summary of the run. Failures
+// to send are only logged, so that they don't change the outcome of the run.
+func (m *mailer) wrap(update func(context.Context) error) func(context.Context) error {
+	if m == nil {
+		return update
+	}
+	return func(ctx context.Context) error {
+		err := update(ctx)
+		m.mu.Lock()
+		results := m.results
+		m.results = nil
+		m.mu.Unlock()
+		subject, body, ok := m.summary(results, err)
+		if !ok {
+			return err
+		}
+		// Send the summary even if ctx timed out, since that is worth
+		// knowing about.
+		sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), smtpTimeout)
+		defer cancel()
+		if err := m.send(sendCtx, subject, body); err != nil {
+			ddns.Logger(ctx).Warn("could not send summary email", "server", m.addr, "err", err)
+		} else {
+			ddns.Logger(ctx).Info("sent summary email", "to", m.to)
+		}
+		return err
+	}
+}
+
+// summary returns the subject and body of the email about a run with
+// results that returned err, and whether it should be sent.
+func (m *mailer) summary(results []ddns.Result, err error) (subject, body string, ok bool) {
+	var changed, failed, addrs []string
+	for _, r := range results {
+		switch r.Status {
+		case ddns.StatusCreated, ddns.StatusUpdated, ddns.StatusDeleted:
+			changed = append(changed, fmt.Sprintf("  %v %v %v: %q -> %q", r.Status, r.Domain, r.Type, r.Old, r.New))
+		case ddns.StatusFailed, ddns.StatusRejected:
+			failed = append(failed, fmt.Sprintf("  %v %v %v: %q", r.Status, r.Domain, r.Type, r.New))
+		}
+		if a := r.Type + " " + r.New; ddns.IsAddressType(r.Type) && r.New != "" && !slices.Contains(addrs, a) {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(changed) == 0 && err == nil && !m.always {
+		return "", "", false
+	}
+	switch {
+	case err != nil:
+		subject = "dyncf: update failed"
+	case len(changed) > 0:
+		subject = fmt.Sprintf("dyncf: %d records changed", len(changed))
+	default:
+		subject = "dyncf: no change"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Detected addresses: %v\n", strings.Join(addrs, ", "))
+	if len(changed) > 0 {
+		fmt.Fprintf(&b, "\nChanged:\n%v\n", strings.Join(changed, "\n"))
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&b, "\nFailed:\n%v\n", strings.Join(failed, "\n"))
+	}
+	if err != nil {
+		fmt.Fprintf(&b, "\nError: %v\n", err)
+	}
+	return subject, b.String(), true
+}
+
+// send emails subject and body to the recipients, using STARTTLS if the
+// server offers it.
+func (m *mailer) send(ctx context.Context, subject, body string) error {
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.user != "" {
+		// PlainAuth refuses to send the password without TLS, except to
+		// localhost.
+		if err := c.Auth(smtp.PlainAuth("", m.user, m.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\nTo: %v\r\nSubject: %v\r\nDate: %v\r\n\r\n", m.from, strings.Join(m.to, ", "), subject, time.Now().Format(time.RFC1123Z))
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
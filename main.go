@@ -1,90 +1,369 @@
 package main
 
 import (
-	"bufio"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"log/slog"
-	"net"
-	"net/http"
+	"math/rand/v2"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
-	"time"
+	"sync"
+	"syscall"
 
-	"github.com/libdns/cloudflare"
 	"github.com/libdns/libdns"
+	"github.com/stvnrhodes/dyncf/ddns"
 )
 
-func getMyIP(recordType string) (net.IP, error) {
-	var netType string
-	switch recordType {
-	case "A":
-		netType = "tcp4"
-	case "AAAA":
-		netType = "tcp6"
+// checkTimeout makes it clear when err was caused by ctx's deadline passing.
+func checkTimeout(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("operation timed out: %w", err)
+	}
+	return err
+}
+
+// newLogger returns a logger that writes to w in the given format, which is
+// either "text" or "json".
+func newLogger(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, func() {
+		slog.Info("shutting down")
+		// Restore the default handlers so that a second signal exits
+		// immediately.
+		stop()
+	})
+
+	if err := run(ctx); err != nil {
+		slog.Error("failed", "err", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// run parses the flags and updates the records, once or continuously. The
+// returned error determines the exit code.
+func run(ctx context.Context) error {
+	cfg := defaultConfig()
+	configPath := flag.String("config", "", "Path to a YAML config file")
+	cfg.registerFlags(flag.CommandLine)
+	ips := flag.String("ip", "", "Comma-separated list of addresses to publish instead of detecting them")
+	dryRun := flag.Bool("dry-run", false, "Log the records that would be changed without changing them")
+	force := flag.Bool("force", false, "Rewrite the records even if they already have the detected values, and ignore -state-file")
+	zone := flag.String("zone", "", "Zone of the record to update, instead of guessing it from -dns-domain")
+	zoneID := flag.String("zone-id", "", "Cloudflare ID of the zone of the record to update, instead of looking it up by name")
+	name := flag.String("name", "", "Name of the record to update within -zone or -zone-id; empty for the zone apex")
+	del := flag.Bool("delete", false, "Delete the records of the selected types instead of updating them")
+	stdin := flag.Bool("stdin", false, "Also read domains from stdin, one per line, ignoring blank lines and # comments")
+	printIP := flag.Bool("print-ip", false, "Print the detected addresses to stdout, one per line, without touching DNS")
+	checkCfg := flag.Bool("check-config", false, "Only check that the config is valid and that the API token can read the zone of every domain, printing a line per domain and exiting with 1 if any fails")
+	check := flag.Bool("check", false, "Only check whether the records match the detected addresses, printing a summary and exiting with 1 if they don't")
+	output := flag.String("output", "", "If json, print the result of each record to stdout as a JSON array, with the logs going to stderr")
+	showVersion := flag.Bool("version", false, "Print the version, commit and build date, and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionInfo())
+		return nil
+	}
+
+	if *configPath != "" {
+		if err := cfg.load(*configPath); err != nil {
+			return configError(fmt.Errorf("could not load config: %w", err))
+		}
+		// Parse again so that flags take precedence over the file.
+		flag.Parse()
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "ttl" {
+			cfg.ttlSet = true
+		}
+	})
+	// stdinDomains are kept for reloading the config, since stdin can't be
+	// read again.
+	var stdinDomains []DomainConfig
+	if *stdin {
+		names, err := readDomains(os.Stdin)
+		if err != nil {
+			return configError(fmt.Errorf("could not read domains from stdin: %w", err))
+		}
+		for _, name := range names {
+			stdinDomains = append(stdinDomains, DomainConfig{Name: name})
+		}
+		cfg.Domains = append(cfg.Domains, stdinDomains...)
+	}
+	// The zone and name can also be given as arguments, where a name of
+	// "@" is the zone apex.
+	switch args := flag.Args(); len(args) {
+	case 0:
+	case 2:
+		if *zone != "" || *zoneID != "" || *name != "" {
+			return configError(errors.New("a zone and name given as arguments can't be combined with -zone, -zone-id or -name"))
+		}
+		*zone, *name = args[0], args[1]
 	default:
-		return nil, fmt.Errorf("unknown record type %v", recordType)
+		return configError(fmt.Errorf("expected no arguments or a zone and a name, got %q", args))
+	}
+	var explicit *ddns.Domain
+	switch {
+	case *zone != "" && *zoneID != "":
+		return configError(errors.New("-zone and -zone-id can't be used together"))
+	case *zone != "":
+		for _, s := range []*string{zone, name} {
+			var err error
+			if *s, err = ddns.ToASCII(*s); err != nil {
+				return configError(err)
+			}
+		}
+		d := explicitDomain(*zone, *name)
+		if err := setExplicitDomain(&cfg, d); err != nil {
+			return configError(err)
+		}
+		explicit = &d
+	case *zoneID != "":
+		if cfg.Provider != "cloudflare" {
+			return configError(errors.New("-zone-id is only supported by cloudflare"))
+		}
+	case *name != "":
+		return configError(errors.New("-name needs -zone or -zone-id"))
 	}
-	client := &http.Client{
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
-				return (&net.Dialer{}).DialContext(ctx, netType, addr)
-			},
-		},
+	err := cfg.validate()
+	if len(cfg.Domains) == 0 && !*printIP && *zoneID == "" {
+		err = errors.Join(errors.New("no domains given"), err)
 	}
-	resp, err := client.Get("https://cloudflare.com/cdn-cgi/trace")
 	if err != nil {
-		return nil, err
+		return configError(fmt.Errorf("invalid config: %w", err))
 	}
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "ip=") {
-			return net.ParseIP(strings.TrimPrefix(scanner.Text(), "ip=")), nil
+	logOut := os.Stdout
+	if *output != "" && *output != "json" {
+		return configError(fmt.Errorf("unsupported output %q", *output))
+	}
+	if *printIP || *check || *checkCfg || *output != "" {
+		// Keep stdout for the addresses or the summary.
+		logOut = os.Stderr
+	}
+	slog.SetDefault(newLogger(logOut, cfg.LogFormat, cfg.LogLevel))
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	source, types, unusable, err := newSource(&cfg, *ips)
+	if err != nil {
+		return err
+	}
+	if *printIP {
+		return printIPs(ctx, os.Stdout, source, types)
+	}
+	if *checkCfg {
+		if *zoneID != "" {
+			return configError(errors.New("-check-config can't be used with -zone-id"))
+		}
+		return checkConfig(ctx, os.Stdout, &cfg)
+	}
+	if cfg.LockFile != "" {
+		f, err := lockFile(ctx, cfg.LockFile, cfg.LockWait)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		slog.Debug("locked", "path", cfg.LockFile)
 	}
-	return nil, fmt.Errorf("no address found")
+	if *force && cfg.Op == "create" {
+		return configError(errors.New("-force can't be used with -op create, which never overwrites records"))
+	}
+	opts := &options{ips: *ips, zoneID: *zoneID, name: *name, explicit: explicit, dryRun: *dryRun, force: *force}
+	s, err := newSetup(ctx, &cfg, opts, source, types, unusable)
+	if err != nil {
+		return err
+	}
+	u := s.u
+	if *output != "" && (cfg.watching() || *check || *del) {
+		return configError(errors.New("-output can't be used with watch mode, -check or -delete"))
+	}
+	if *check {
+		if cfg.watching() || *del {
+			return configError(errors.New("-check can't be used with watch mode or -delete"))
+		}
+		changes, err := u.Check(ctx)
+		if err != nil {
+			return checkTimeout(ctx, err)
+		}
+		fmt.Println(checkSummary(changes, s.domains))
+		if len(changes) > 0 {
+			return &exitError{code: exitFailure, err: fmt.Errorf("%d records are out of date", len(changes))}
+		}
+		return nil
+	}
+	if *del {
+		if cfg.watching() {
+			return configError(errors.New("-delete can't be used in watch mode"))
+		}
+		if cfg.Op != "set" {
+			return configError(fmt.Errorf("-delete can't be used with -op %v", cfg.Op))
+		}
+		return checkTimeout(ctx, u.Delete(ctx))
+	}
+	if !cfg.watching() {
+		if cfg.MetricsAddr != "" {
+			slog.Warn("ignoring -metrics-addr, which needs watch mode")
+		}
+		if cfg.ControlSocket != "" {
+			slog.Warn("ignoring -control-socket, which needs watch mode")
+		}
+		if *output == "" {
+			return checkTimeout(ctx, s.update(ctx))
+		}
+		var mu sync.Mutex
+		results := []ddns.Result{}
+		s.onResult = append(s.onResult, func(_ context.Context, r ddns.Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, r)
+		})
+		err := s.update(ctx)
+		if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+			slog.Error("could not write results", "err", err)
+		}
+		return checkTimeout(ctx, err)
+	}
+	slog.Info("running as daemon", "interval", cfg.Interval)
+	if cfg.MetricsAddr != "" {
+		history.size = cfg.HistorySize
+		if err := serveMetrics(ctx, cfg.MetricsAddr, cfg.HealthStaleness); err != nil {
+			return configError(fmt.Errorf("could not serve metrics: %w", err))
+		}
+	}
+	var kicks chan struct{}
+	if cfg.ControlSocket != "" {
+		kicks = make(chan struct{}, 1)
+		if err := serveControl(ctx, cfg.ControlSocket, kicks); err != nil {
+			return configError(fmt.Errorf("could not serve control socket: %w", err))
+		}
+		slog.Info("serving control socket", "path", cfg.ControlSocket)
+	}
+	r := newReloader(*configPath, cfg, opts, stdinDomains, s)
+	go r.run(ctx)
+	var changes <-chan struct{}
+	if cfg.WatchNetlink {
+		var err error
+		if changes, err = watchAddrChanges(ctx, cfg.Interface); err != nil {
+			return err
+		}
+		slog.Info("watching address changes", "interface", cfg.Interface)
+		changes = flushOn(changes, r.flush)
+	}
+	if cfg.StartupJitter > 0 {
+		delay := rand.N(cfg.StartupJitter)
+		slog.Info("delaying first update", "delay", delay)
+		if !sleep(ctx, delay) {
+			return nil
+		}
+	}
+	watch(ctx, r.update, cfg.Interval, cfg.MaxBackoff, changes, r.reloaded, kicks)
+	return nil
 }
 
-func main() {
-	ctx := context.Background()
+// account is a provider account that holds some of the zones.
+type account struct {
+	provider ddns.Provider
+	cf       *ddns.CloudflareClient
+	lister   libdns.ZoneLister
+}
 
-	domain := flag.String("dns-domain", "", "Domain to update")
-	flag.Parse()
+// resolveDomains resolves the names of domains, using the zones of the
+// account of each domain's profile.
+func resolveDomains(ctx context.Context, domains []DomainConfig, accounts map[string]account) ([]ddns.Domain, error) {
+	resolved := make([]ddns.Domain, len(domains))
+	byProfile := make(map[string][]int)
+	for i, d := range domains {
+		byProfile[d.Profile] = append(byProfile[d.Profile], i)
+	}
+	for profile, indexes := range byProfile {
+		names := make([]string, len(indexes))
+		for j, i := range indexes {
+			names[j] = domains[i].Name
+		}
+		ds, err := ddns.ResolveDomains(ctx, accounts[profile].lister, names)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indexes {
+			resolved[i] = ds[j]
+		}
+	}
+	return resolved, nil
+}
 
-	parts := strings.Split(*domain, ".")
-	if len(parts) < 3 {
-		log.Fatalf("too few domain labels in %q", *domain)
+// explicitDomain returns the domain named name within zone, which is the apex
+// if name is empty.
+func explicitDomain(zone, name string) ddns.Domain {
+	d := ddns.Domain{Zone: strings.TrimSuffix(zone, "."), Subdomain: name}
+	if d.Subdomain == "" {
+		d.Subdomain = "@"
 	}
-	zone := strings.Join(parts[len(parts)-2:], ".")
-	subdomain := strings.Join(parts[:len(parts)-2], ".")
-	slog.Info("parsed domain", "zone", zone, "subdomain", subdomain)
+	return d
+}
 
-	apiToken := os.Getenv("CLOUDFLARE_API_TOKEN")
-	if apiToken == "" {
-		log.Fatal("CLOUDFLARE_API_TOKEN env var is missing")
+// setExplicitDomain makes d the only domain of cfg, failing if cfg already
+// names another one.
+func setExplicitDomain(cfg *Config, d ddns.Domain) error {
+	switch {
+	case len(cfg.Domains) == 0:
+		cfg.Domains = []DomainConfig{{Name: d.Name()}}
+	case len(cfg.Domains) > 1 || strings.TrimSuffix(cfg.Domains[0].Name, ".") != d.Name():
+		return fmt.Errorf("-dns-domain %v doesn't match the zone and -name, which give %v", strings.Join(domainNames(cfg.Domains), ","), d.Name())
+	}
+	return nil
+}
+
+// checkSummary describes the result of checking n domains in one line.
+func checkSummary(changes []ddns.Change, n int) string {
+	if len(changes) == 0 {
+		return fmt.Sprintf("OK: the records of %d domains are current", n)
+	}
+	var diffs []string
+	for _, c := range changes {
+		diffs = append(diffs, fmt.Sprintf("%v %v %v -> %v", c.Domain, c.Type, cmp.Or(c.Old, "(none)"), cmp.Or(c.New, "(none)")))
 	}
-	provider := cloudflare.Provider{APIToken: apiToken}
+	return fmt.Sprintf("OUT OF DATE: %d records differ: %v", len(changes), strings.Join(diffs, ", "))
+}
 
-	var records []libdns.Record
-	for _, recordType := range []string{"A", "AAAA"} {
-		addr, err := getMyIP(recordType)
+// printIPs writes the addresses that source detects for the address types in
+// recordTypes to w, one per line. It only fails if no address was detected.
+func printIPs(ctx context.Context, w io.Writer, source ddns.IPSource, recordTypes []string) error {
+	addrTypes := slices.DeleteFunc(slices.Clone(recordTypes), func(t string) bool { return !ddns.IsAddressType(t) })
+	var errs []error
+	printed := false
+	for _, recordType := range addrTypes {
+		addrs, err := ddns.DetectIPs(ctx, source, recordType)
 		if err != nil {
-			log.Fatalf("could not get v4 address: %v", err)
+			slog.Error("could not detect address", "type", recordType, "err", err)
+			errs = append(errs, detectError(fmt.Errorf("could not get %v address: %w", recordType, err)))
+			continue
+		}
+		for _, addr := range addrs {
+			fmt.Fprintln(w, addr)
+			printed = true
 		}
-		records = append(records, libdns.Record{
-			Type:  recordType,
-			Name:  subdomain,
-			Value: addr.String(),
-			TTL:   5 * time.Minute,
-		})
-		slog.Info("will set record", "type", recordType, "value", addr)
 	}
-
-	result, err := provider.SetRecords(ctx, zone, records)
-	if err != nil {
-		log.Fatalf("could not update records: %v", err)
+	if printed {
+		return nil
 	}
-	slog.Info("updated records", "records", result)
+	return errors.Join(errs...)
 }
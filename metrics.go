@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	updatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyncf_updates_total",
+		Help: "Number of update cycles, by result.",
+	}, []string{"result"})
+	ipChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dyncf_ip_changes_total",
+		Help: "Number of times the detected address changed, by record type.",
+	}, []string{"type"})
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dyncf_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful update cycle.",
+	})
+)
+
+func init() {
+	// Export both results from the start so that rate() works on the first
+	// failure.
+	updatesTotal.WithLabelValues("success")
+	updatesTotal.WithLabelValues("error")
+}
+
+// recordUpdate updates the metrics and status with the result of an update
+// cycle.
+func recordUpdate(err error) {
+	status.record(err)
+	if err != nil {
+		updatesTotal.WithLabelValues("error").Inc()
+		return
+	}
+	updatesTotal.WithLabelValues("success").Inc()
+	lastSuccessTimestamp.SetToCurrentTime()
+}
+
+// serveMetrics starts serving /metrics, /healthz and /history on addr in the
+// background until ctx is done. It only returns an error if it can't listen
+// on addr. The health check fails if no update succeeded within staleness.
+func serveMetrics(ctx context.Context, addr string, staleness time.Duration) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(staleness))
+	mux.Handle("/history", historyHandler())
+	srv := &http.Server{Handler: mux}
+	context.AfterFunc(ctx, func() { srv.Close() })
+	go func() {
+		if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// netlinkSettle is how long address changes must stop before they are
+// reported, so that a burst of them, or an IPv6 address that is still being
+// configured, causes a single update.
+const netlinkSettle = 2 * time.Second
+
+// watchAddrChanges returns a channel that receives a value after addresses
+// are added to or removed from the interface named iface, or any interface if
+// iface is empty. It stops watching when ctx is done.
+func watchAddrChanges(ctx context.Context, iface string) (<-chan struct{}, error) {
+	index := 0
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("could not find interface %v: %w", iface, err)
+		}
+		index = i.Index
+	}
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("could not open netlink socket: %w", err)
+	}
+	groups := uint32(1<<(syscall.RTNLGRP_IPV4_IFADDR-1) | 1<<(syscall.RTNLGRP_IPV6_IFADDR-1))
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not subscribe to address changes: %w", err)
+	}
+	// Wrapping the non-blocking socket in a file lets Close interrupt a
+	// pending Read.
+	f := os.NewFile(uintptr(fd), "netlink")
+	context.AfterFunc(ctx, func() { f.Close() })
+
+	changes := make(chan struct{}, 1)
+	settled := time.AfterFunc(time.Hour, func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	settled.Stop()
+	go func() {
+		defer settled.Stop()
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					ddns.Logger(ctx).Error("stopped watching address changes", "err", err)
+				}
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				ddns.Logger(ctx).Warn("could not parse netlink message", "err", err)
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWADDR && m.Header.Type != syscall.RTM_DELADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+					continue
+				}
+				// The interface index follows the family, prefix
+				// length, flags and scope bytes of the ifaddrmsg.
+				if index != 0 && int(binary.NativeEndian.Uint32(m.Data[4:8])) != index {
+					continue
+				}
+				ddns.Logger(ctx).Debug("address changed", "new", m.Header.Type == syscall.RTM_NEWADDR)
+				settled.Reset(netlinkSettle)
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchAddrChanges reports address changes, which needs netlink and so only
+// works on Linux.
+func watchAddrChanges(context.Context, string) (<-chan struct{}, error) {
+	return nil, errors.New("watching address changes is only supported on Linux")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// webhook posts a JSON notification of every change to a URL. A nil
+// *webhook does nothing.
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhook(url string) *webhook {
+	return &webhook{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// notify posts c to the webhook. Failures are only logged, so that they
+// don't fail the update.
+func (w *webhook) notify(ctx context.Context, c ddns.Change) {
+	if w == nil {
+		return
+	}
+	if err := w.post(ctx, c); err != nil {
+		ddns.Logger(ctx).Warn("could not send notification", "url", w.url, "err", err)
+	}
+}
+
+func (w *webhook) post(ctx context.Context, c ddns.Change) error {
+	body, err := json.Marshal(struct {
+		ddns.Change
+		Timestamp time.Time `json:"timestamp"`
+	}{c, time.Now()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// pinger pings a dead man's switch monitor, like healthchecks.io, after each
+// update run, so that it alerts when the runs stop. A nil *pinger does
+// nothing.
+type pinger struct {
+	url string
+	// fail pings url with /fail appended after a failed run, instead of
+	// skipping the ping.
+	fail   bool
+	client *http.Client
+}
+
+func newPinger(url string, fail bool) *pinger {
+	if url == "" {
+		return nil
+	}
+	return &pinger{url: url, fail: fail, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// wrap returns update, followed by a ping of the monitor. Failures to ping
+// are only logged, so that they don't change the outcome of the run.
+func (p *pinger) wrap(update func(context.Context) error) func(context.Context) error {
+	if p == nil {
+		return update
+	}
+	return func(ctx context.Context) error {
+		err := update(ctx)
+		url := p.url
+		if err != nil {
+			if !p.fail {
+				return err
+			}
+			url = strings.TrimSuffix(url, "/") + "/fail"
+		}
+		if perr := p.ping(context.WithoutCancel(ctx), url); perr != nil {
+			ddns.Logger(ctx).Warn("could not ping monitor", "url", url, "err", perr)
+		}
+		return err
+	}
+}
+
+func (p *pinger) ping(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
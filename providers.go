@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/stvnrhodes/dyncf/ddns"
+	"golang.org/x/time/rate"
+)
+
+// backend is a DNS hosting service that records can be published to.
+type backend struct {
+	// tokenEnv is the environment variable holding the API token unless
+	// configured otherwise.
+	tokenEnv string
+	// new returns the provider that token gives access to, which must
+	// wait for limiter before each of its API requests, since one call
+	// can make several.
+	new func(token string, limiter *rate.Limiter) ddns.Provider
+}
+
+// backends are the services accepted by -provider. A backend's provider must
+// implement ddns.Provider, the libdns interfaces to get, append, set and
+// delete records. If it also implements libdns.ZoneLister, names are matched
+// to the zones it lists; otherwise each zone is assumed to be the last two
+// labels of its names. The proxying, -ttl auto and -zone-id need the
+// provider to be a *ddns.CloudflareClient, and -manage-ptr needs a zone
+// lister, so validate and main reject them for the other backends by name.
+var backends = map[string]backend{
+	"cloudflare": {
+		tokenEnv: "CLOUDFLARE_API_TOKEN",
+		new: func(token string, limiter *rate.Limiter) ddns.Provider {
+			return &ddns.CloudflareClient{Token: token, Limiter: limiter}
+		},
+	},
+	"desec": {
+		tokenEnv: "DESEC_TOKEN",
+		new: func(token string, limiter *rate.Limiter) ddns.Provider {
+			return &ddns.DesecClient{Token: token, Limiter: limiter}
+		},
+	},
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// startupKeys are the config keys that only take effect at startup, so
+// changing them needs a restart.
+var startupKeys = []string{"mode", "interval", "max_backoff", "startup_jitter", "watch_netlink", "timeout", "metrics_addr", "health_staleness", "history_size", "control_socket", "lock_file", "lock_wait", "log_format", "log_level"}
+
+// reloader keeps the setup that watch mode updates with, and replaces it with
+// one built from the config file whenever the process gets SIGHUP. The new
+// setup takes over from the next update, remembering what the old one did.
+type reloader struct {
+	path string
+	opts *options
+	// stdinDomains are the domains read from stdin at startup, which are
+	// kept since stdin can't be read again.
+	stdinDomains []DomainConfig
+	// cfg is the config last loaded, only used by run.
+	cfg Config
+
+	cur, next atomic.Pointer[setup]
+	// reloaded gets a value when a new setup is waiting to be used.
+	reloaded chan struct{}
+}
+
+func newReloader(path string, cfg Config, opts *options, stdinDomains []DomainConfig, s *setup) *reloader {
+	r := &reloader{path: path, opts: opts, stdinDomains: stdinDomains, cfg: cfg, reloaded: make(chan struct{}, 1)}
+	r.cur.Store(s)
+	return r
+}
+
+// update switches to the reloaded setup, if there is one, and updates the
+// records with it.
+func (r *reloader) update(ctx context.Context) error {
+	s := r.cur.Load()
+	if next := r.next.Swap(nil); next != nil {
+		next.u.Inherit(s.u)
+		r.cur.Store(next)
+		s = next
+	}
+	return s.update(ctx)
+}
+
+// flush forgets the addresses cached by the current setup.
+func (r *reloader) flush() {
+	r.cur.Load().cached.Flush()
+}
+
+// run reloads the config whenever the process gets SIGHUP, until ctx is done.
+// An invalid config is logged and ignored, leaving the previous one in use.
+func (r *reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if r.path == "" {
+			slog.Warn("got SIGHUP, but there is no -config to reload")
+			continue
+		}
+		slog.Info("got SIGHUP, reloading config", "path", r.path)
+		cfg, s, err := r.load(ctx)
+		if err != nil {
+			slog.Error("rejected reloaded config, keeping the previous one", "path", r.path, "err", err)
+			continue
+		}
+		changed := configChanges(r.cfg, cfg)
+		slog.Info("reloaded config", "path", r.path, "changed", changed)
+		if keys := slices.DeleteFunc(changed, func(k string) bool { return !slices.Contains(startupKeys, k) }); len(keys) > 0 {
+			slog.Warn("some changed settings only take effect after a restart", "keys", keys)
+		}
+		r.cfg = cfg
+		r.next.Store(s)
+		select {
+		case r.reloaded <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// load reads the config file again and builds its setup. The flags given on
+// the command line still take precedence over the file, and the domains from
+// stdin or the zone flags are kept.
+func (r *reloader) load(ctx context.Context) (Config, *setup, error) {
+	cfg := defaultConfig()
+	if err := cfg.load(r.path); err != nil {
+		return cfg, nil, fmt.Errorf("could not load config: %w", err)
+	}
+	// Parse the command line again onto the new config. The flags that
+	// aren't settings still set the variables that run reads, to the same
+	// values as at startup.
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg.registerFlags(fs)
+	flag.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return cfg, nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "ttl" {
+			cfg.ttlSet = true
+		}
+	})
+	cfg.Domains = append(cfg.Domains, r.stdinDomains...)
+	if r.opts.explicit != nil {
+		if err := setExplicitDomain(&cfg, *r.opts.explicit); err != nil {
+			return cfg, nil, err
+		}
+	}
+	err := cfg.validate()
+	if len(cfg.Domains) == 0 {
+		err = errors.Join(errors.New("no domains given"), err)
+	}
+	if err != nil {
+		return cfg, nil, fmt.Errorf("invalid config: %w", err)
+	}
+	source, types, unusable, err := newSource(&cfg, r.opts.ips)
+	if err != nil {
+		return cfg, nil, err
+	}
+	s, err := newSetup(ctx, &cfg, r.opts, source, types, unusable)
+	return cfg, s, err
+}
+
+// configChanges returns the keys of the settings that differ between old and
+// new, as they are named in the config file.
+func configChanges(old, new Config) []string {
+	var a, b map[string]any
+	for _, c := range []struct {
+		cfg Config
+		m   *map[string]any
+	}{{old, &a}, {new, &b}} {
+		out, err := yaml.Marshal(c.cfg)
+		if err == nil {
+			err = yaml.Unmarshal(out, c.m)
+		}
+		if err != nil {
+			return []string{"(unknown)"}
+		}
+	}
+	var keys []string
+	for k, v := range a {
+		if !reflect.DeepEqual(v, b[k]) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
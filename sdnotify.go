@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify sends state, such as "READY=1", to the systemd service manager.
+// It does nothing if the process wasn't started by systemd with
+// NotifyAccess.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/stvnrhodes/dyncf/ddns"
+	"golang.org/x/time/rate"
+)
+
+// options are the command line settings that apply to the whole run, and
+// aren't changed by reloading the config.
+type options struct {
+	ips string
+	// zoneID and name select the only domain by the ID of its zone, which
+	// is looked up into explicit. explicit can also be given directly.
+	zoneID, name  string
+	explicit      *ddns.Domain
+	dryRun, force bool
+}
+
+// setup is the updater that run builds from the config.
+type setup struct {
+	u *ddns.Updater
+	// update runs u.Update followed by any summary email and monitor
+	// ping.
+	update func(context.Context) error
+	// domains is how many domains u updates.
+	domains int
+	// cached is the cache of the source of u, if there is one.
+	cached *ddns.CachedSource
+	// onResult are called with every result of u.
+	onResult []func(context.Context, ddns.Result)
+}
+
+// newSource returns the source of the addresses configured by cfg, or the
+// addresses in ips if it isn't empty. It also returns the record types to
+// publish, and a func reporting whether a type can't be published because
+// ips has no address for it.
+func newSource(cfg *Config, ips string) (source ddns.IPSource, types []string, unusable func(string) bool, err error) {
+	types = cfg.allRecordTypes()
+	// unusable reports whether records of a type can't be published, which
+	// is the case for address types that -ip gives no address for.
+	unusable = func(string) bool { return false }
+	if ips != "" {
+		static, err := ddns.ParseStaticSource(ips)
+		if err != nil {
+			return nil, nil, nil, configError(err)
+		}
+		for t, addr := range static {
+			if !slices.Contains(types, t) {
+				return nil, nil, nil, configError(fmt.Errorf("address %v needs an %v record, which is not in -record-types", addr, t))
+			}
+		}
+		unusable = func(t string) bool {
+			_, ok := static[t]
+			return ddns.IsAddressType(t) && !ok
+		}
+		types = slices.DeleteFunc(types, unusable)
+		source = static
+	} else if cfg.IPCommand != "" {
+		source = ddns.CommandSource{Command: cfg.IPCommand, Timeout: cfg.IPCommandTimeout}
+	} else {
+		f := &ddns.Fetcher{Timeout: cfg.HTTPTimeout, NoProxy: cfg.NoProxy, UserAgent: cfg.UserAgent, Fallback: cfg.DetectFallback}
+		if cfg.Resolver != "" {
+			var err error
+			if f.Resolver, err = ddns.NewResolver(cfg.Resolver); err != nil {
+				return nil, nil, nil, configError(err)
+			}
+		}
+		for recordType, bind := range map[string]string{"A": cfg.Bind4, "AAAA": cfg.Bind6} {
+			var addr net.IP
+			var err error
+			switch {
+			case bind != "":
+				addr, err = ddns.ParseBindAddr(bind, recordType)
+			case cfg.Interface != "" && slices.Contains(types, recordType):
+				addr, err = ddns.InterfaceAddr(cfg.Interface, recordType)
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, nil, nil, configError(err)
+			}
+			if f.Local == nil {
+				f.Local = make(map[string]net.IP)
+			}
+			f.Local[recordType] = addr
+			slog.Info("binding detection", "type", recordType, "addr", addr)
+		}
+		source, err = ddns.ParseIPSources(cfg.IPSources, cfg.TraceURL, cfg.STUNServer, f)
+		if err != nil {
+			return nil, nil, nil, configError(err)
+		}
+		source = ddns.WithBreakers(source, cfg.BreakerThreshold, cfg.BreakerCooldown)
+		if source, err = ddns.WithWeights(source, cfg.IPSourceWeights); err != nil {
+			return nil, nil, nil, configError(err)
+		}
+		if source, err = ddns.WithQuorum(source, cfg.Quorum); err != nil {
+			return nil, nil, nil, configError(err)
+		}
+	}
+
+	if cfg.V6Suffix != "" {
+		// validate has already checked the suffix.
+		suffix, _ := ddns.ParseV6Suffix(cfg.V6Suffix)
+		source = ddns.PrefixSource{Source: source, Suffix: suffix}
+	}
+	return source, types, unusable, nil
+}
+
+// newLimiter returns the limiter of the API requests to the DNS provider,
+// which all accounts share.
+func newLimiter(cfg *Config) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(cfg.RateLimit), max(1, int(cfg.RateLimit)))
+}
+
+// newAccount returns the account of the DNS provider of cfg that token gives
+// access to.
+func newAccount(cfg *Config, limiter *rate.Limiter, token string) account {
+	a := account{provider: backends[cfg.Provider].new(token, limiter)}
+	a.cf, _ = a.provider.(*ddns.CloudflareClient)
+	a.lister, _ = a.provider.(libdns.ZoneLister)
+	return a
+}
+
+// newSetup builds the updater configured by cfg and opts, which publishes
+// types from source.
+func newSetup(ctx context.Context, cfg *Config, opts *options, source ddns.IPSource, types []string, unusable func(string) bool) (*setup, error) {
+	var cached *ddns.CachedSource
+	if cfg.DetectCacheTTL > 0 {
+		cached = &ddns.CachedSource{Source: source, TTL: cfg.DetectCacheTTL}
+		source = cached
+	}
+
+	limiter := newLimiter(cfg)
+	accounts := make(map[string]account)
+	if opts.zoneID != "" || slices.ContainsFunc(cfg.Domains, func(d DomainConfig) bool { return d.Profile == "" }) {
+		apiToken, err := cfg.apiToken()
+		if err != nil {
+			return nil, configError(err)
+		}
+		accounts[""] = newAccount(cfg, limiter, apiToken)
+	}
+	for name, p := range cfg.Profiles {
+		token, err := p.token()
+		if err != nil {
+			return nil, configError(fmt.Errorf("profile %v: %w", name, err))
+		}
+		accounts[name] = newAccount(cfg, limiter, token)
+	}
+	cf := accounts[""].cf
+
+	// A zone given by ID is only looked up once, and kept on reloads.
+	if opts.zoneID != "" && opts.explicit == nil {
+		zoneName, err := cf.ZoneName(ctx, opts.zoneID)
+		if err != nil {
+			return nil, ddns.APIError(checkTimeout(ctx, fmt.Errorf("could not look up zone %v: %w", opts.zoneID, err)))
+		}
+		d := explicitDomain(zoneName, opts.name)
+		if err := setExplicitDomain(cfg, d); err != nil {
+			return nil, configError(err)
+		}
+		opts.explicit = &d
+	}
+	var domains []ddns.Domain
+	if opts.explicit != nil {
+		domains = []ddns.Domain{*opts.explicit}
+	} else {
+		var err error
+		if domains, err = resolveDomains(ctx, cfg.Domains, accounts); err != nil {
+			return nil, configError(checkTimeout(ctx, err))
+		}
+	}
+	zoneProfiles := make(map[string]string)
+	for i := range domains {
+		d, dc := &domains[i], cfg.Domains[i]
+		if p, ok := zoneProfiles[d.Zone]; ok && p != dc.Profile {
+			return nil, configError(fmt.Errorf("%v uses profile %q, but other domains of zone %v use %q", d.Name(), dc.Profile, d.Zone, p))
+		}
+		zoneProfiles[d.Zone] = dc.Profile
+		if dc.Profile != "" {
+			d.Provider, d.Cloudflare = accounts[dc.Profile].provider, accounts[dc.Profile].cf
+		}
+		d.TTL = time.Duration(cmp.Or(dc.TTL, cfg.TTL))
+		d.KeepAutoTTL = dc.TTL == 0 && !cfg.ttlSet
+		d.Proxied = cfg.Proxied
+		if dc.Proxied != nil {
+			d.Proxied = *dc.Proxied
+		}
+		d.RecordTypes = cfg.RecordTypes
+		if len(dc.RecordTypes) > 0 {
+			d.RecordTypes = dc.RecordTypes
+		}
+		d.RecordTypes = slices.DeleteFunc(slices.Clone(d.RecordTypes), unusable)
+		slog.Info("parsed domain", "zone", d.Zone, "subdomain", d.Subdomain, "types", d.RecordTypes, "ttl", recordTTL(d.TTL), "proxied", d.Proxied, "profile", dc.Profile)
+		if u := ddns.ToUnicode(d.Name()); u != d.Name() {
+			slog.Info("domain has an international name", "name", d.Name(), "unicode", u)
+		}
+		if d.Subdomain == "@" && slices.Contains(d.RecordTypes, "CNAME") {
+			return nil, configError(fmt.Errorf("%v is a zone apex, which can't have a CNAME record", d.Name()))
+		}
+	}
+	fixed := make(map[string]string)
+	if slices.Contains(types, "CNAME") {
+		fixed["CNAME"] = cfg.CNAMETarget
+	}
+	if slices.Contains(types, "TXT") {
+		fixed["TXT"] = cfg.TXTValue
+	}
+	var srv *ddns.SRV
+	if slices.Contains(types, "SRV") {
+		srv = &ddns.SRV{
+			Service:  cfg.SRVService,
+			Proto:    cfg.SRVProto,
+			Port:     uint(cfg.SRVPort),
+			Priority: uint(cfg.SRVPriority),
+			Weight:   uint(cfg.SRVWeight),
+		}
+	}
+
+	u := &ddns.Updater{
+		Provider:          accounts[""].provider,
+		Cloudflare:        cf,
+		Source:            source,
+		Domains:           domains,
+		RecordTypes:       types,
+		Fixed:             fixed,
+		SRV:               srv,
+		Comment:           cfg.Comment,
+		SyncTTL:           cfg.SyncTTL,
+		SyncProxied:       cfg.SyncProxied,
+		AllowPrivate:      cfg.AllowPrivate,
+		RequireConsistent: cfg.RequireConsistent,
+		Debounce:          cfg.Debounce,
+		Retry:             ddns.Retrier{MaxRetries: cfg.MaxRetries, BaseDelay: time.Second, MaxDelay: 30 * time.Second},
+		// Reads back off less, so that retrying them doesn't use up
+		// the time left for the writes.
+		ReadRetry:          ddns.Retrier{MaxRetries: cfg.MaxRetries, BaseDelay: time.Second, MaxDelay: 5 * time.Second},
+		ReadTimeout:        cfg.ReadTimeout,
+		WriteOnReadFailure: cfg.watching(),
+		DryRun:             opts.dryRun,
+		Force:              opts.force,
+		Append:             cfg.Op == "append",
+		CreateOnly:         cfg.Op == "create",
+		OnMissing:          cfg.OnMissing,
+		ManagePTR:          cfg.ManagePTR,
+		ReverseZones:       accounts[""].lister,
+		Concurrency:        cfg.Concurrency,
+		OnAddressChange: func(recordType string, old, new []net.IP) {
+			ipChangesTotal.WithLabelValues(recordType).Inc()
+			history.add(recordType, old, new)
+		},
+		OnDetect: status.detected,
+	}
+	for _, cidr := range cfg.AllowCIDRs {
+		_, n, _ := net.ParseCIDR(cidr)
+		u.AllowNets = append(u.AllowNets, n)
+	}
+	if cfg.StateFile != "" {
+		u.State = ddns.LoadState(cfg.StateFile)
+	}
+	verify, err := newVerifier(cfg, domains)
+	if err != nil {
+		return nil, configError(err)
+	}
+	onChange := []func(context.Context, ddns.Change){verify.record}
+	if cfg.NotifyWebhook != "" {
+		onChange = append(onChange, newWebhook(cfg.NotifyWebhook).notify)
+	}
+	if cfg.PostHook != "" {
+		onChange = append(onChange, func(ctx context.Context, c ddns.Change) {
+			if err := runHook(ctx, cfg.PostHook, c); err != nil {
+				ddns.Logger(ctx).Warn("post-hook failed", "domain", c.Domain, "type", c.Type, "err", err)
+			}
+		})
+	}
+	u.OnChange = func(ctx context.Context, c ddns.Change) {
+		for _, f := range onChange {
+			f(ctx, c)
+		}
+	}
+	mail, err := newMailer(cfg)
+	if err != nil {
+		return nil, configError(err)
+	}
+	s := &setup{
+		u:        u,
+		update:   newPinger(cfg.PingURL, cfg.PingFail).wrap(mail.wrap(verify.wrap(u.Update))),
+		domains:  len(domains),
+		cached:   cached,
+		onResult: []func(context.Context, ddns.Result){mail.record},
+	}
+	// onResult is read on every call, so that later additions apply.
+	u.OnResult = func(ctx context.Context, r ddns.Result) {
+		for _, f := range s.onResult {
+			f(ctx, r)
+		}
+	}
+	if cfg.PreHook != "" {
+		u.BeforeChange = func(ctx context.Context, c ddns.Change) error {
+			return runHook(ctx, cfg.PreHook, c)
+		}
+	}
+	return s, nil
+}
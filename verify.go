@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// verifyPoll is how often a changed record is looked up again until it has
+// its new value.
+const verifyPoll = 5 * time.Second
+
+// verifier checks that the records changed by a run can be resolved with
+// their new values, by looking them up after the run until window has
+// passed. Records that don't resolve as expected in time are only logged,
+// since caches can lag. A nil *verifier does nothing.
+type verifier struct {
+	// resolver looks up the records. If nil, they are looked up on an
+	// authoritative server of their zone.
+	resolver *net.Resolver
+	window   time.Duration
+	// proxied are the domains whose records are proxied, which resolve to
+	// Cloudflare's addresses rather than to their values.
+	proxied map[string]bool
+
+	mu      sync.Mutex
+	changes []ddns.Change
+}
+
+// newVerifier returns the verifier configured by cfg for domains, or nil if
+// there is none.
+func newVerifier(cfg *Config, domains []ddns.Domain) (*verifier, error) {
+	if !cfg.Verify {
+		return nil, nil
+	}
+	v := &verifier{window: cfg.VerifyWindow, proxied: make(map[string]bool)}
+	if cfg.VerifyResolver != "" {
+		var err error
+		if v.resolver, err = ddns.NewResolver(cfg.VerifyResolver); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range domains {
+		if d.Proxied {
+			v.proxied[d.Name()] = true
+		}
+	}
+	return v, nil
+}
+
+// record remembers c to be verified after the current run.
+func (v *verifier) record(ctx context.Context, c ddns.Change) {
+	if v == nil {
+		return
+	}
+	switch {
+	case c.Type != "A" && c.Type != "AAAA" && c.Type != "TXT":
+		ddns.Logger(ctx).Debug("not verifying record of this type", "domain", c.Domain, "type", c.Type)
+		return
+	case v.proxied[c.Domain] && ddns.IsAddressType(c.Type):
+		ddns.Logger(ctx).Debug("not verifying proxied record", "domain", c.Domain, "type", c.Type)
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.changes = append(v.changes, c)
+}
+
+// wrap returns update, followed by verifying the records that it changed.
+// Verification doesn't change the outcome of the run.
+func (v *verifier) wrap(update func(context.Context) error) func(context.Context) error {
+	if v == nil {
+		return update
+	}
+	return func(ctx context.Context) error {
+		err := update(ctx)
+		v.mu.Lock()
+		changes := v.changes
+		v.changes = nil
+		v.mu.Unlock()
+		ctx, cancel := context.WithTimeout(ctx, v.window)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, c := range changes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v.verify(ctx, c)
+			}()
+		}
+		wg.Wait()
+		return err
+	}
+}
+
+// verify looks up the record of c until it has the new value or ctx is done,
+// and logs the outcome.
+func (v *verifier) verify(ctx context.Context, c ddns.Change) {
+	log := ddns.Logger(ctx).With("domain", c.Domain, "type", c.Type)
+	r := v.resolver
+	if r == nil {
+		var err error
+		if r, err = authoritativeResolver(ctx, c.Domain); err != nil {
+			log.Warn("could not verify record", "err", err)
+			return
+		}
+	}
+	var values []string
+	var err error
+	for {
+		values, err = lookupValues(ctx, r, c.Domain, c.Type)
+		// A deleted record is verified once its old value is gone.
+		if err == nil && (c.New == "" && !slices.Contains(values, c.Old) || c.New != "" && slices.Contains(values, c.New)) {
+			log.Info("verified record", "values", values)
+			return
+		}
+		if !sleep(ctx, verifyPoll) {
+			break
+		}
+	}
+	if err != nil {
+		log.Warn("record not verified in time", "window", v.window, "err", err)
+		return
+	}
+	log.Warn("record not verified in time, it may still be propagating", "window", v.window, "want", cmp.Or(c.New, "(none)"), "got", values)
+}
+
+// authoritativeResolver returns a resolver that queries an authoritative
+// server of the zone of name, found by looking up the NS records of name and
+// then of its parents.
+func authoritativeResolver(ctx context.Context, name string) (*net.Resolver, error) {
+	for n := strings.TrimSuffix(name, "."); strings.Contains(n, "."); n = n[strings.IndexByte(n, '.')+1:] {
+		ns, err := net.DefaultResolver.LookupNS(ctx, n)
+		if err != nil || len(ns) == 0 {
+			continue
+		}
+		return ddns.NewResolver(strings.TrimSuffix(ns[0].Host, "."))
+	}
+	return nil, fmt.Errorf("could not find the name servers of %v", name)
+}
+
+// lookupValues returns the values of the records of recordType at name.
+func lookupValues(ctx context.Context, r *net.Resolver, name, recordType string) ([]string, error) {
+	var values []string
+	var err error
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		var addrs []net.IP
+		addrs, err = r.LookupIP(ctx, network, name)
+		for _, addr := range addrs {
+			values = append(values, addr.String())
+		}
+	case "TXT":
+		values, err = r.LookupTXT(ctx, name)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return values, err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// version returns the module version this binary was built from, or
+// "devel" if it wasn't built from a tagged module.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "devel"
+	}
+	return info.Main.Version
+}
+
+// versionInfo describes the build, including the commit and its date when the
+// binary was built from a checkout.
+func versionInfo() string {
+	commit, date, modified := "unknown", "unknown", false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.time":
+				date = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+	}
+	if modified {
+		commit += " (modified)"
+	}
+	return fmt.Sprintf("dyncf %v, commit %v, built %v", version(), commit, date)
+}
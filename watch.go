@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/stvnrhodes/dyncf/ddns"
+)
+
+// shutdownGrace is how long an update that is in flight when shutdown starts
+// may keep running.
+const shutdownGrace = 30 * time.Second
+
+// backoffAfter is how many updates in a row must fail before watch starts
+// waiting longer than the interval between them.
+const backoffAfter = 3
+
+// watch runs update immediately and then once per interval until ctx is
+// done. Failed updates are logged and retried on the next tick, and after
+// backoffAfter failures in a row the wait doubles each time, up to
+// maxBackoff. A value from changes, reloads or kicks also starts an update
+// right away. Every log of an update carries its run_id. systemd is told
+// that the service is ready after the first successful update, and its
+// watchdog is pinged after every one.
+func watch(ctx context.Context, update func(context.Context) error, interval, maxBackoff time.Duration, changes, reloads, kicks <-chan struct{}) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	ready := false
+	failures := 0
+	for runID := 1; ; runID++ {
+		log := ddns.Logger(ctx).With("run_id", runID)
+		cycleCtx, cancel := cycleContext(ddns.WithLogger(ctx, log))
+		err := update(cycleCtx)
+		cancel()
+		if err != nil {
+			log.Error("update failed", "err", err)
+			failures++
+		} else {
+			failures = 0
+		}
+		recordUpdate(err)
+		if err == nil {
+			state := "WATCHDOG=1"
+			if !ready {
+				state = "READY=1\nWATCHDOG=1"
+				ready = true
+			}
+			if err := sdNotify(state); err != nil {
+				log.Warn("could not notify systemd", "err", err)
+			}
+		}
+		delay := cycleDelay(interval, maxBackoff, failures)
+		if delay > interval {
+			log.Warn("backing off after repeated failures", "failures", failures, "delay", delay)
+		}
+		timer.Reset(delay)
+		status.scheduled(time.Now().Add(delay))
+		select {
+		case <-ctx.Done():
+			if err := sdNotify("STOPPING=1"); err != nil {
+				log.Warn("could not notify systemd", "err", err)
+			}
+			return
+		case <-changes:
+			log.Info("network changed, updating early")
+		case <-reloads:
+			log.Info("config reloaded, updating early")
+		case <-kicks:
+			log.Info("kicked through the control socket, updating early")
+		case <-timer.C:
+		}
+	}
+}
+
+// cycleDelay returns how long to wait for the next update after failures
+// updates in a row have failed.
+func cycleDelay(interval, maxBackoff time.Duration, failures int) time.Duration {
+	if failures < backoffAfter || maxBackoff <= interval {
+		return interval
+	}
+	delay := interval
+	for range failures - backoffAfter + 1 {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// flushOn returns a channel that passes on the values from changes after
+// calling flush, e.g. so that an update started by a change detects afresh.
+func flushOn(changes <-chan struct{}, flush func()) <-chan struct{} {
+	out := make(chan struct{}, 1)
+	go func() {
+		for range changes {
+			flush()
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return out
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// cycleContext returns a context for a single update that outlives ctx by up
+// to shutdownGrace, so that an update isn't cut off halfway through.
+func cycleContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	cycleCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(shutdownGrace, cancel)
+	})
+	return cycleCtx, func() {
+		stop()
+		cancel()
+	}
+}